@@ -0,0 +1,58 @@
+// Package backoff 拉流重试的指数退避，不依赖引擎
+package backoff
+
+import (
+	"math"
+	"time"
+)
+
+// 没有任何上限时翻倍到这里为止，加上随机浮动也不会溢出
+const unbounded = time.Duration(math.MaxInt64 / 4)
+
+// Policy 退避参数
+type Policy struct {
+	Backoff    time.Duration // 第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff time.Duration // 翻倍的上限，0为不限
+	MaxDelay   time.Duration // 加上随机浮动之后的上限，0为不限
+	Jitter     float64       // 随机浮动的比例，限制在0到1之间
+}
+
+// Delay 返回第 attempt 次（从1开始）重试前的等待时间，r 为 [0,1) 的随机数
+func (p Policy) Delay(attempt int, r float64) time.Duration {
+	limit := unbounded
+	if p.MaxBackoff > 0 && p.MaxBackoff < limit {
+		limit = p.MaxBackoff
+	}
+	if p.MaxDelay > 0 && p.MaxDelay < limit {
+		limit = p.MaxDelay
+	}
+	d := p.Backoff
+	for i := 1; i < attempt && d > 0 && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	if jitter := math.Max(0, math.Min(p.Jitter, 1)); jitter > 0 {
+		d += time.Duration(float64(d) * jitter * (2*r - 1))
+	}
+	// 浮点误差可能让结果略小于0
+	if d < 0 {
+		d = 0
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// Total 返回前 attempts 次重试最长的等待时间之和，超过 math.MaxInt64/4 时按其计算
+func (p Policy) Total(attempts int) (total time.Duration) {
+	for i := 1; i <= attempts && total < unbounded; i++ {
+		total += p.Delay(i, 1)
+	}
+	if total > unbounded {
+		total = unbounded
+	}
+	return
+}
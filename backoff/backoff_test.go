@@ -0,0 +1,73 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: 30 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 5: 16 * time.Second, 6: 30 * time.Second, 100: 30 * time.Second} {
+		if d := p.Delay(attempt, 0.5); d != want {
+			t.Errorf("attempt %d: %v, want %v", attempt, d, want)
+		}
+	}
+}
+
+// MaxBackoff 为0时由 MaxDelay 限制
+func TestDelayMaxDelay(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxDelay: time.Minute}
+	if d := p.Delay(6, 0.5); d != 32*time.Second {
+		t.Errorf("attempt 6: %v", d)
+	}
+	if d := p.Delay(7, 0.5); d != time.Minute {
+		t.Errorf("attempt 7: %v", d)
+	}
+	if d := p.Delay(1000, 0.5); d != time.Minute {
+		t.Errorf("attempt 1000: %v", d)
+	}
+	// 随机浮动之后也不超过 MaxDelay
+	p.Jitter = 0.5
+	if d := p.Delay(1000, 0.99); d != time.Minute {
+		t.Errorf("jitter: %v", d)
+	}
+	if d := p.Delay(1000, 0); d != 30*time.Second {
+		t.Errorf("jitter: %v", d)
+	}
+}
+
+// 都不设上限时不会溢出
+func TestDelayUnbounded(t *testing.T) {
+	p := Policy{Backoff: time.Second, Jitter: 1}
+	for _, r := range []float64{0, 0.5, 0.999} {
+		if d := p.Delay(1000, r); d < 0 {
+			t.Errorf("r %v: %v", r, d)
+		}
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	p := Policy{Backoff: 10 * time.Second, Jitter: 0.2}
+	if d := p.Delay(1, 0); d != 8*time.Second {
+		t.Errorf("r 0: %v", d)
+	}
+	if d := p.Delay(1, 0.75); d != 11*time.Second {
+		t.Errorf("r 0.75: %v", d)
+	}
+	// 超过1的比例按1计算，等待时间不会为负数
+	p.Jitter = 3
+	if d := p.Delay(1, 0); d != 0 {
+		t.Errorf("jitter 3: %v", d)
+	}
+}
+
+func TestTotal(t *testing.T) {
+	p := Policy{Backoff: time.Second, MaxBackoff: 4 * time.Second, Jitter: 0.5}
+	// 1.5+3+6+6
+	if total := p.Total(4); total != 16500*time.Millisecond {
+		t.Errorf("total %v", total)
+	}
+	if total := (Policy{Backoff: time.Second}).Total(1000); total != unbounded {
+		t.Errorf("unbounded total %v", total)
+	}
+}
@@ -0,0 +1,145 @@
+package hls
+
+import (
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	NALU_H264_SEI        = 6
+	NALU_H265_SEI_PREFIX = 39
+	SEI_USER_DATA_T35    = 4 // user_data_registered_itu_t_t35
+)
+
+// detectCaptions 检查帧中的SEI是否带有 CEA-608 隐藏字幕，发现新的通道时返回 true
+func (t *VideoTrackReader) detectCaptions(frame *common.AVFrame) (changed bool) {
+	frame.AUList.Range(func(au *util.BLL) bool {
+		var sei []byte
+		switch t.CodecID {
+		case codec.CodecID_H264:
+			if au.GetByte(0)&0x1f == NALU_H264_SEI {
+				sei = au.ToBytes()[1:]
+			}
+		case codec.CodecID_H265:
+			if au.GetByte(0)>>1&0x3f == NALU_H265_SEI_PREFIX && au.ByteLength > 2 {
+				sei = au.ToBytes()[2:]
+			}
+		}
+		if sei == nil {
+			return true
+		}
+		for _, id := range seiCaptions(sei) {
+			if !hasCaption(t.captions, id) {
+				t.captions = append(t.captions, id)
+				changed = true
+			}
+		}
+		return true
+	})
+	return
+}
+
+func hasCaption(captions []string, id string) bool {
+	for _, c := range captions {
+		if c == id {
+			return true
+		}
+	}
+	return false
+}
+
+// seiCaptions 解析SEI中 ATSC A/53 的 cc_data，返回其中带有数据的 CEA-608 通道
+func seiCaptions(sei []byte) (ids []string) {
+	data := unescapeRBSP(sei)
+	// 最后一个字节是 rbsp_trailing_bits
+	for len(data) > 1 {
+		var payloadType, payloadSize int
+		for len(data) > 0 && data[0] == 0xff {
+			payloadType += 0xff
+			data = data[1:]
+		}
+		if len(data) == 0 {
+			return
+		}
+		payloadType += int(data[0])
+		data = data[1:]
+		for len(data) > 0 && data[0] == 0xff {
+			payloadSize += 0xff
+			data = data[1:]
+		}
+		if len(data) == 0 {
+			return
+		}
+		payloadSize += int(data[0])
+		data = data[1:]
+		if payloadSize > len(data) {
+			return
+		}
+		payload := data[:payloadSize]
+		data = data[payloadSize:]
+		// itu_t_t35_country_code=0xB5, provider_code=0x0031, user_identifier="GA94", user_data_type_code=0x03
+		if payloadType != SEI_USER_DATA_T35 || len(payload) < 10 || payload[0] != 0xb5 || payload[1] != 0 || payload[2] != 0x31 || string(payload[3:7]) != "GA94" || payload[7] != 3 {
+			continue
+		}
+		ccCount := int(payload[8] & 0x1f)
+		cc := payload[10:]
+		for i := 0; i < ccCount && len(cc) >= 3; i, cc = i+1, cc[3:] {
+			// cc_valid 为0或者是填充数据
+			if cc[0]&0x04 == 0 || cc[1]&0x7f == 0 && cc[2]&0x7f == 0 {
+				continue
+			}
+			var id string
+			switch cc[0] & 0x03 {
+			case 0:
+				id = "CC1"
+			case 1:
+				id = "CC3"
+			default:
+				continue // CEA-708 的 DTVCC 数据
+			}
+			if !hasCaption(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return
+}
+
+// unescapeRBSP 去掉 NALU 中的防竞争字节 0x03
+func unescapeRBSP(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// escapeRBSP 在连续两个0之后的 0x00-0x03 前插入防竞争字节 0x03
+func escapeRBSP(data []byte) []byte {
+	result := make([]byte, 0, len(data)+len(data)/64+1)
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b <= 3 {
+			result = append(result, 3)
+			zeros = 0
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		result = append(result, b)
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package hls
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+var ErrInvalidCipherText = errors.New("invalid aes-128 cipher text")
+var ErrSampleAESFMP4 = errors.New("sample-aes in fmp4 is not supported")
+
+// aesReader 解密 AES-128 CBC 加密的切片，最后一个分组在读到结尾后去掉 PKCS7 填充
+type aesReader struct {
+	io.ReadCloser
+	mode    cipher.BlockMode
+	chunk   []byte
+	pending []byte // 尚未解密的密文，读到结尾前至少保留一个分组
+	out     []byte // 已解密未读取的明文
+	eof     bool
+}
+
+func newAESReader(body io.ReadCloser, key, iv []byte) (*aesReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		ReadCloser: body,
+		mode:       cipher.NewCBCDecrypter(block, iv),
+		chunk:      make([]byte, 32*1024),
+	}, nil
+}
+
+func (r *aesReader) Read(b []byte) (n int, err error) {
+	for len(r.out) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if err = r.fill(); err != nil {
+			return
+		}
+	}
+	n = copy(b, r.out)
+	r.out = r.out[n:]
+	return
+}
+
+func (r *aesReader) fill() error {
+	n, err := r.ReadCloser.Read(r.chunk)
+	r.pending = append(r.pending, r.chunk[:n]...)
+	if err == io.EOF {
+		r.eof = true
+		l := len(r.pending)
+		if l == 0 || l%aes.BlockSize != 0 {
+			return ErrInvalidCipherText
+		}
+		r.mode.CryptBlocks(r.pending, r.pending)
+		if pad := int(r.pending[l-1]); pad > 0 && pad <= aes.BlockSize {
+			r.out = r.pending[:l-pad]
+			r.pending = nil
+			return nil
+		}
+		return ErrInvalidCipherText
+	} else if err != nil {
+		return err
+	}
+	if m := (len(r.pending) - 1) / aes.BlockSize * aes.BlockSize; m > 0 {
+		r.mode.CryptBlocks(r.pending[:m], r.pending[:m])
+		r.out = r.pending[:m]
+		r.pending = r.pending[m:]
+	}
+	return nil
+}
+
+// sequenceIV 没有指定IV时，使用切片的媒体序号作为IV
+func sequenceIV(sequence int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	return iv
+}
+
+// fetchKey 下载 #EXT-X-KEY 的密钥
+func fetchKey(ctx context.Context, client *http.Client, keyURL string, header http.Header) (key []byte, err error) {
+	if key, err = fetchBytes(ctx, client, keyURL, header, aes.BlockSize); err == nil && len(key) != aes.BlockSize {
+		err = fmt.Errorf("invalid key length %d from %s", len(key), keyURL)
+	}
+	return
+}
+
+// segmentKeys 拉流时缓存的密钥，每次刷新播放列表后只保留仍在使用的密钥，以支持密钥轮换
+type segmentKeys struct {
+	cached map[string][]byte
+	used   map[string][]byte
+}
+
+// get 返回切片的密钥和IV，key 为空或者 METHOD=NONE 时返回空
+func (k *segmentKeys) get(p *HLSPuller, client *http.Client, base *http.Request, key *m3u8.Key, sequence int) (aesKey, iv []byte, err error) {
+	if key == nil || key.Method == m3u8.KEY_METHOD_NONE {
+		return
+	}
+	if key.Method != m3u8.KEY_METHOD_AES_128 && key.Method != m3u8.KEY_METHOD_SAMPLE_AES {
+		return nil, nil, fmt.Errorf("unsupported key method %s", key.Method)
+	}
+	if key.KeyFormat != "" && key.KeyFormat != "identity" {
+		return nil, nil, fmt.Errorf("unsupported key format %s", key.KeyFormat)
+	}
+	keyURL, err := base.URL.Parse(key.URI)
+	if err != nil {
+		return
+	}
+	if k.used == nil {
+		k.used = make(map[string][]byte)
+	}
+	if aesKey = k.used[keyURL.String()]; aesKey == nil {
+		if aesKey = k.cached[keyURL.String()]; aesKey == nil {
+			if aesKey, err = fetchKey(p.Context, client, keyURL.String(), p.TsHead); err != nil {
+				return
+			}
+		}
+		k.used[keyURL.String()] = aesKey
+	}
+	if iv = key.IV; len(iv) == 0 {
+		iv = sequenceIV(sequence)
+	} else if len(iv) != aes.BlockSize {
+		return nil, nil, fmt.Errorf("invalid iv length %d", len(iv))
+	}
+	return
+}
+
+// refresh 播放列表处理完成后调用，丢弃不再使用的密钥
+func (k *segmentKeys) refresh() {
+	k.cached, k.used = k.used, nil
+}
+
+// decrypt 根据切片的密钥返回解密后的内容
+func (p *TSDownloader) decrypt(body io.ReadCloser) (io.ReadCloser, error) {
+	if p.aesKey == nil {
+		return body, nil
+	}
+	if p.key.Method == m3u8.KEY_METHOD_SAMPLE_AES {
+		if p.initMap != nil {
+			return nil, ErrSampleAESFMP4
+		}
+		return newSampleAESReader(body, p.aesKey, p.iv)
+	}
+	return newAESReader(body, p.aesKey, p.iv)
+}
@@ -0,0 +1,273 @@
+package hls
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+// 音视频分离的上游（音轨在单独的播放列表中）不再各自喂给 TSReader，
+// 而是把两边的切片拆成PES，按解码时间戳交错后由同一个 TSReader 解析
+
+const (
+	PID_DEMUX_PMT   = 0x1001
+	PID_DEMUX_AUDIO = 0x1100     // 音轨的流重新分配的起始PID，避免与视频的PID冲突
+	demuxMaxLead    = 10 * 90000 // 一边超前另一边超过10秒时不再等待
+)
+
+// demuxStream 保留的一个流，音轨的流会换成新的PID
+type demuxStream struct {
+	pmtStream
+	outPID uint16
+}
+
+// tsUnit 一个PES对应的ts包
+type tsUnit struct {
+	dts  uint64
+	data []byte
+}
+
+// demuxSource 视频或音轨一边尚未输出的PES
+type demuxSource struct {
+	audio   bool
+	pmtPID  int
+	streams []demuxStream
+	units   []tsUnit
+	last    map[uint16]uint64 // 每个PID最后的时间戳，用于没有时间戳的PES
+	ended   bool
+}
+
+type demuxFeeder struct {
+	sync.Mutex
+	reader  *TSReader
+	sources [2]demuxSource // 视频、音轨
+	tables  []byte         // PAT和PMT
+	changed bool           // 流发生变化，需要重新生成PAT和PMT
+	closed  bool
+}
+
+func newDemuxFeeder() *demuxFeeder {
+	d := new(demuxFeeder)
+	for i := range d.sources {
+		d.sources[i] = demuxSource{audio: i == 1, pmtPID: -1, last: make(map[uint16]uint64)}
+	}
+	return d
+}
+
+// isAudioStreamType 音轨播放列表中保留的流类型，视频播放列表中同时带有音频时丢弃
+func isAudioStreamType(streamType byte) bool {
+	switch streamType {
+	case mpegts.STREAM_TYPE_AAC, 0x03, 0x04, 0x11, 0x81, 0x87:
+		return true
+	}
+	return false
+}
+
+// push 读取一个切片，按时间戳输出两边都已经到达的部分
+func (d *demuxFeeder) push(p *HLSPuller, audio bool, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return nil
+	}
+	source := &d.sources[0]
+	if audio {
+		source = &d.sources[1]
+	}
+	if err = d.parse(source, data); err == nil {
+		d.feed(p)
+	}
+	return err
+}
+
+// end 一边结束后另一边不再等待，两边都结束时关闭 TSReader
+func (d *demuxFeeder) end(p *HLSPuller, audio bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return
+	}
+	d.sources[0].ended = d.sources[0].ended || !audio
+	d.sources[1].ended = d.sources[1].ended || audio
+	d.feed(p)
+	if d.sources[0].ended && d.sources[1].ended {
+		d.closed = true
+		if d.reader != nil {
+			d.reader.Close()
+		}
+	}
+}
+
+// parse 把切片拆成PES，只保留视频一边的非音频流和音轨一边的音频流
+func (d *demuxFeeder) parse(source *demuxSource, data []byte) error {
+	open := make(map[uint16]int) // 每个PID正在拼接的PES
+	for ; len(data) >= mpegts.TS_PACKET_SIZE; data = data[mpegts.TS_PACKET_SIZE:] {
+		packet := data[:mpegts.TS_PACKET_SIZE]
+		if packet[0] != 0x47 {
+			return ErrInvalidTsPacket
+		}
+		pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+		pusi := packet[1]&0x40 != 0
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if int(payload[0]) >= len(payload) {
+				return ErrInvalidTsPacket
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if packet[3]&0x10 == 0 {
+			payload = nil
+		}
+		switch stream := source.stream(pid); {
+		case pid == 0 && pusi:
+			source.pmtPID = parsePAT(psiSection(payload))
+		case int(pid) == source.pmtPID && pusi:
+			if streams := source.keepStreams(psiSection(payload)); streams != nil && !sameStreams(streams, source.streams) {
+				source.streams = streams
+				d.changed = true
+			}
+		case stream != nil:
+			packet = append([]byte(nil), packet...)
+			packet[1] = packet[1]&0xe0 | byte(stream.outPID>>8)&0x1f
+			packet[2] = byte(stream.outPID)
+			if pusi {
+				dts, ok := pesDTS(payload)
+				if !ok {
+					dts = source.last[pid]
+				}
+				source.last[pid] = dts
+				open[pid] = len(source.units)
+				source.units = append(source.units, tsUnit{dts: dts, data: packet})
+			} else if i, ok := open[pid]; ok {
+				source.units[i].data = append(source.units[i].data, packet...)
+			}
+		}
+	}
+	return nil
+}
+
+func (source *demuxSource) stream(pid uint16) *demuxStream {
+	for i := range source.streams {
+		if source.streams[i].pid == pid {
+			return &source.streams[i]
+		}
+	}
+	return nil
+}
+
+// keepStreams 返回PMT中这一边保留的流
+func (source *demuxSource) keepStreams(section []byte) (streams []demuxStream) {
+	pmt, ok := parsePMT(section)
+	if !ok {
+		return
+	}
+	for _, s := range pmt.streams {
+		if isAudioStreamType(s.streamType) != source.audio {
+			continue
+		}
+		outPID := s.pid
+		if source.audio {
+			outPID = PID_DEMUX_AUDIO + uint16(len(streams))
+		}
+		streams = append(streams, demuxStream{s, outPID})
+	}
+	return
+}
+
+func sameStreams(a, b []demuxStream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].pid != b[i].pid || a[i].streamType != b[i].streamType || !bytes.Equal(a[i].info, b[i].info) {
+			return false
+		}
+	}
+	return true
+}
+
+// pesDTS 返回PES的解码时间戳，只有PTS时使用PTS
+func pesDTS(payload []byte) (uint64, bool) {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return 0, false
+	}
+	switch payload[7] >> 6 {
+	case 2:
+		return getTimestamp(payload[9:]), true
+	case 3:
+		if len(payload) >= 19 {
+			return getTimestamp(payload[14:]), true
+		}
+	}
+	return 0, false
+}
+
+// before 考虑33位时间戳的回绕
+func before(a, b uint64) bool {
+	d := (b - a) & maxTimestamp
+	return d != 0 && d < 1<<32
+}
+
+// lead 已经到达但还没有输出的时长
+func (source *demuxSource) lead() uint64 {
+	if len(source.units) == 0 {
+		return 0
+	}
+	return (source.units[len(source.units)-1].dts - source.units[0].dts) & maxTimestamp
+}
+
+// feed 两边都有PES时输出时间戳小的一个，一边结束或超前太多时直接输出
+func (d *demuxFeeder) feed(p *HLSPuller) {
+	video, audio := &d.sources[0], &d.sources[1]
+	var out []byte
+	for {
+		var source *demuxSource
+		switch {
+		case len(video.units) > 0 && len(audio.units) > 0:
+			source = video
+			if before(audio.units[0].dts, video.units[0].dts) {
+				source = audio
+			}
+		case len(video.units) > 0 && (audio.ended || video.lead() > demuxMaxLead):
+			source = video
+		case len(audio.units) > 0 && (video.ended || audio.lead() > demuxMaxLead):
+			source = audio
+		}
+		if source == nil {
+			break
+		}
+		out = append(out, source.units[0].data...)
+		source.units = source.units[1:]
+	}
+	if len(out) == 0 {
+		return
+	}
+	if d.changed || d.tables == nil {
+		d.writeTables()
+	}
+	if d.reader == nil {
+		d.reader = NewTSReader(&p.TSPublisher)
+	}
+	d.reader.Feed(io.MultiReader(bytes.NewReader(d.tables), bytes.NewReader(out)))
+}
+
+// writeTables 生成包含两边所有流的PAT和PMT
+func (d *demuxFeeder) writeTables() {
+	d.changed = false
+	streams := append(append([]demuxStream(nil), d.sources[0].streams...), d.sources[1].streams...)
+	if len(streams) == 0 {
+		return
+	}
+	pmt := pmtTable{pcrPID: streams[0].outPID}
+	for _, s := range streams {
+		pmt.streams = append(pmt.streams, pmtStream{pid: s.outPID, streamType: s.streamType, info: s.info})
+	}
+	d.tables = append(psiPacket(0, patSection(PID_DEMUX_PMT)), psiPacket(PID_DEMUX_PMT, pmt.section())...)
+}
@@ -0,0 +1,108 @@
+package hls
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+var ErrPlaylistStalled = errors.New("playlist stopped updating")
+var ErrSegmentsFailed = errors.New("all segments failed to download")
+
+const playlistTimeout = 10 * time.Second // 请求播放列表的最短超时
+
+// upstreams 同一路流的多个上游地址，出错、停止更新或超时时按顺序切换
+type upstreams struct {
+	sources  []*http.Request // 拉流地址和备用地址，可以是主播放列表
+	media    []*http.Request // 主播放列表中与所选变体相同的冗余变体
+	source   int
+	index    int
+	failures int       // 连续失败的次数，所有地址都失败后放弃
+	switched bool      // 切换之后的第一个切片与之前不连续
+	updated  time.Time // 播放列表最后一次更新的时间
+	timeout  time.Duration
+}
+
+// backupURLs 拉流时的备用地址，为空时使用配置中按流路径设置的 backups
+func (p *HLSPuller) backupURLs() []string {
+	if len(p.Backups) > 0 {
+		return p.Backups
+	}
+	return strings.Fields(hlsConfig.Backups[p.Stream.Path])
+}
+
+func newUpstreams(req *http.Request, backups []string) *upstreams {
+	u := &upstreams{sources: []*http.Request{req}, updated: time.Now(), timeout: playlistTimeout}
+	for _, backup := range backups {
+		if backupReq, err := http.NewRequest("GET", backup, nil); err == nil {
+			backupReq.Header = req.Header
+			u.sources = append(u.sources, backupReq)
+		} else {
+			HLSPlugin.Error("backup", zap.String("url", backup), zap.Error(err))
+		}
+	}
+	return u
+}
+
+// redundant 记录主播放列表中与所选变体码率、分辨率和编码都相同的变体，第一个是所选的变体
+func (u *upstreams) redundant(master *http.Request, selected *m3u8.Variant, variants []*m3u8.Variant) {
+	u.media, u.index = nil, 0
+	add := func(v *m3u8.Variant) {
+		if url, err := master.URL.Parse(v.URI); err == nil {
+			req, _ := http.NewRequest("GET", url.String(), nil)
+			req.Header = master.Header
+			u.media = append(u.media, req)
+		}
+	}
+	add(selected)
+	for _, v := range variants {
+		if v != selected && !v.IFrame && v.URI != selected.URI && v.Bandwidth == selected.Bandwidth && v.Width == selected.Width && v.Height == selected.Height && v.Codecs == selected.Codecs {
+			add(v)
+		}
+	}
+}
+
+// success 播放列表请求成功，有更新时记录更新时间，并按目标时长调整超时
+func (u *upstreams) success(changed bool, targetDuration int) {
+	u.failures = 0
+	if changed {
+		u.updated = time.Now()
+	}
+	if u.timeout = time.Duration(targetDuration) * 3 * time.Second; u.timeout < playlistTimeout {
+		u.timeout = playlistTimeout
+	}
+}
+
+// stalled 超过三个目标时长没有更新
+func (u *upstreams) stalled(targetDuration int) bool {
+	if targetDuration <= 0 {
+		targetDuration = 10
+	}
+	return time.Since(u.updated) > time.Duration(targetDuration)*3*time.Second
+}
+
+// failover 切换到下一个地址，依次尝试冗余变体和备用地址，没有可用的地址时返回 nil
+func (u *upstreams) failover(p *HLSPuller, reason error) (req *http.Request) {
+	if u.failures++; len(u.sources) < 2 && len(u.media) < 2 || u.failures > len(u.sources)+len(u.media) {
+		return nil
+	}
+	if u.index+1 < len(u.media) {
+		u.index++
+		req = u.media[u.index]
+	} else if len(u.sources) > 1 {
+		u.source = (u.source + 1) % len(u.sources)
+		u.media, u.index = nil, 0
+		req = u.sources[u.source]
+	} else {
+		u.index = 0
+		req = u.media[0]
+	}
+	u.switched = true
+	u.updated = time.Now()
+	HLSPlugin.Warn("failover", zap.String("streamPath", p.Stream.Path), zap.String("url", req.URL.String()), zap.Error(reason))
+	return
+}
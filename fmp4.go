@@ -0,0 +1,657 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// fMP4/CMAF 切片转封装成ts后再交给 TSReader，转发和保存也都使用转封装后的ts
+
+const (
+	STREAM_ID_VIDEO = 0xe0
+	STREAM_ID_AUDIO = 0xc0
+	PID_FMP4_PMT    = 0x1000
+	PID_FMP4_START  = 0x100
+)
+
+const maxInitSize = 1 << 20 // 初始化片段的大小上限
+
+var ErrInvalidFMP4 = errors.New("invalid fmp4")
+var ErrNoFMP4Track = errors.New("no supported track in fmp4 init segment")
+var ErrUnsupportedFMP4Track = errors.New("unsupported fmp4 track")
+
+// fmp4Track 初始化片段中的一个轨道
+type fmp4Track struct {
+	id              uint32
+	timescale       uint32
+	pid             uint16
+	streamType      byte
+	nalLength       int      // NALU 长度字段的字节数
+	params          [][]byte // SPS、PPS、VPS，加在关键帧之前
+	profile         byte     // AAC 的 audioObjectType
+	frequency       byte     // AAC 的 samplingFrequencyIndex
+	channels        byte
+	defaultDuration uint32
+	defaultSize     uint32
+	defaultFlags    uint32
+}
+
+// fmp4Init 解析后的初始化片段
+type fmp4Init struct {
+	tracks  []*fmp4Track
+	pcrPID  uint16
+	pat     []byte
+	pmt     []byte
+	cc      map[uint16]byte // 每个PID最后输出的 continuity_counter，跨切片保持连续
+	skipped []error         // 不支持而跳过的轨道，例如 TSReader 无法发布的 Opus
+}
+
+// fmp4Sample 片段中的一帧
+type fmp4Sample struct {
+	track *fmp4Track
+	dts   uint64 // 90kHz
+	pts   uint64
+	key   bool
+	data  []byte
+}
+
+// rangeBoxes 遍历 data 中的 box
+func rangeBoxes(data []byte, f func(typ string, payload []byte, offset int) error) error {
+	for offset := 0; offset+8 <= len(data); {
+		size, header := uint64(binary.BigEndian.Uint32(data[offset:])), 8
+		switch size {
+		case 0:
+			size = uint64(len(data) - offset)
+		case 1:
+			if offset+16 > len(data) {
+				return ErrInvalidFMP4
+			}
+			size, header = binary.BigEndian.Uint64(data[offset+8:]), 16
+		}
+		if size < uint64(header) || size > uint64(len(data)-offset) {
+			return ErrInvalidFMP4
+		}
+		if err := f(string(data[offset+4:offset+8]), data[offset+header:offset+int(size)], offset); err != nil {
+			return err
+		}
+		offset += int(size)
+	}
+	return nil
+}
+
+// findBox 返回 data 中路径为 path 的第一个 box
+func findBox(data []byte, path ...string) (payload []byte) {
+	rangeBoxes(data, func(typ string, b []byte, _ int) error {
+		if payload == nil && typ == path[0] {
+			if len(path) == 1 {
+				payload = b
+			} else {
+				payload = findBox(b, path[1:]...)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// parseFMP4Init 解析初始化片段中的 H.264、H.265 和 AAC 轨道，其他轨道记录在 skipped 中
+func parseFMP4Init(data []byte) (fi *fmp4Init, err error) {
+	moov := findBox(data, "moov")
+	if moov == nil {
+		return nil, ErrInvalidFMP4
+	}
+	fi = &fmp4Init{cc: make(map[uint16]byte)}
+	err = rangeBoxes(moov, func(typ string, trak []byte, _ int) error {
+		if typ != "trak" {
+			return nil
+		}
+		track := &fmp4Track{pid: PID_FMP4_START + uint16(len(fi.tracks))}
+		tkhd, mdhd, stsd := findBox(trak, "tkhd"), findBox(trak, "mdia", "mdhd"), findBox(trak, "mdia", "minf", "stbl", "stsd")
+		if len(tkhd) < 24 || len(mdhd) < 24 || len(stsd) < 16 {
+			return nil
+		}
+		if tkhd[0] == 1 {
+			track.id = binary.BigEndian.Uint32(tkhd[20:])
+		} else {
+			track.id = binary.BigEndian.Uint32(tkhd[12:])
+		}
+		if mdhd[0] == 1 {
+			track.timescale = binary.BigEndian.Uint32(mdhd[20:])
+		} else {
+			track.timescale = binary.BigEndian.Uint32(mdhd[12:])
+		}
+		if track.timescale == 0 {
+			return ErrInvalidFMP4
+		}
+		// 只使用第一个 sample entry
+		return rangeBoxes(stsd[8:], func(entry string, b []byte, offset int) error {
+			if offset > 0 {
+				return nil
+			}
+			if err := track.parseSampleEntry(entry, b); err != nil {
+				fi.skipped = append(fi.skipped, fmt.Errorf("track %d %s: %w", track.id, entry, err))
+				return nil
+			}
+			fi.tracks = append(fi.tracks, track)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fi.tracks) == 0 {
+		if len(fi.skipped) > 0 {
+			return nil, fmt.Errorf("%w: %v", ErrNoFMP4Track, fi.skipped)
+		}
+		return nil, ErrNoFMP4Track
+	}
+	rangeBoxes(findBox(moov, "mvex"), func(typ string, trex []byte, _ int) error {
+		if typ == "trex" && len(trex) >= 24 {
+			for _, track := range fi.tracks {
+				if track.id == binary.BigEndian.Uint32(trex[4:]) {
+					track.defaultDuration = binary.BigEndian.Uint32(trex[12:])
+					track.defaultSize = binary.BigEndian.Uint32(trex[16:])
+					track.defaultFlags = binary.BigEndian.Uint32(trex[20:])
+				}
+			}
+		}
+		return nil
+	})
+	fi.writeTables()
+	return
+}
+
+func (track *fmp4Track) to90k(t uint64) uint64 {
+	timescale := uint64(track.timescale)
+	return t/timescale*90000 + t%timescale*90000/timescale
+}
+
+func (track *fmp4Track) parseSampleEntry(entry string, b []byte) error {
+	switch entry {
+	case "avc1", "avc3":
+		if len(b) < 78 {
+			return ErrInvalidFMP4
+		}
+		avcC := findBox(b[78:], "avcC")
+		if len(avcC) < 7 {
+			return ErrInvalidFMP4
+		}
+		track.streamType = mpegts.STREAM_TYPE_H264
+		track.nalLength = int(avcC[4]&0x03) + 1
+		rest := avcC[5:]
+		for _, mask := range []byte{0x1f, 0xff} {
+			if len(rest) == 0 {
+				break
+			}
+			n := int(rest[0] & mask)
+			rest = rest[1:]
+			for ; n > 0 && len(rest) >= 2; n-- {
+				l := int(binary.BigEndian.Uint16(rest))
+				if l+2 > len(rest) {
+					return ErrInvalidFMP4
+				}
+				track.params = append(track.params, rest[2:2+l])
+				rest = rest[2+l:]
+			}
+		}
+	case "hvc1", "hev1":
+		if len(b) < 78 {
+			return ErrInvalidFMP4
+		}
+		hvcC := findBox(b[78:], "hvcC")
+		if len(hvcC) < 23 {
+			return ErrInvalidFMP4
+		}
+		track.streamType = mpegts.STREAM_TYPE_H265
+		track.nalLength = int(hvcC[21]&0x03) + 1
+		rest := hvcC[23:]
+		for arrays := int(hvcC[22]); arrays > 0 && len(rest) >= 3; arrays-- {
+			n := int(binary.BigEndian.Uint16(rest[1:]))
+			rest = rest[3:]
+			for ; n > 0 && len(rest) >= 2; n-- {
+				l := int(binary.BigEndian.Uint16(rest))
+				if l+2 > len(rest) {
+					return ErrInvalidFMP4
+				}
+				track.params = append(track.params, rest[2:2+l])
+				rest = rest[2+l:]
+			}
+		}
+	case "mp4a":
+		if len(b) < 28 {
+			return ErrInvalidFMP4
+		}
+		asc := esdsConfig(findBox(b[28:], "esds"))
+		if len(asc) < 2 {
+			return ErrInvalidFMP4
+		}
+		track.streamType = mpegts.STREAM_TYPE_AAC
+		track.profile = byte(ascBits(asc, 0, 5))
+		track.frequency = byte(ascBits(asc, 5, 4))
+		track.channels = byte(ascBits(asc, 9, 4))
+		if track.profile == 5 || track.profile == 29 {
+			// HE-AAC 的 ADTS 使用基础的 audioObjectType 和核心采样率，由解码器隐式处理 SBR 和 PS
+			offset := 17
+			if ascBits(asc, 13, 4) == 0x0f {
+				offset += 24
+			}
+			track.profile = byte(ascBits(asc, offset, 5))
+		}
+		if track.profile == 0 || track.profile > 4 || track.frequency > 12 {
+			return ErrUnsupportedFMP4Track
+		}
+	default:
+		// Opus 等 TSReader 不能发布的编码
+		return ErrUnsupportedFMP4Track
+	}
+	return nil
+}
+
+// ascBits 读取 AudioSpecificConfig 中从第 offset 位开始的 n 位，越界时返回 -1
+func ascBits(asc []byte, offset, n int) int {
+	if offset+n > len(asc)*8 {
+		return -1
+	}
+	v := 0
+	for i := offset; i < offset+n; i++ {
+		v = v<<1 | int(asc[i/8]>>(7-i%8)&1)
+	}
+	return v
+}
+
+// esdsConfig 返回 esds 中 DecoderSpecificInfo 的 AudioSpecificConfig
+func esdsConfig(esds []byte) []byte {
+	if len(esds) < 4 {
+		return nil
+	}
+	data := esds[4:]
+	for len(data) > 2 {
+		tag := data[0]
+		size, i := 0, 1
+		for ; i < 5 && i < len(data); i++ {
+			size = size<<7 | int(data[i]&0x7f)
+			if data[i]&0x80 == 0 {
+				break
+			}
+		}
+		data = data[i+1:]
+		switch tag {
+		case 0x03: // ES_Descriptor
+			if len(data) < 3 {
+				return nil
+			}
+			flags, skip := data[2], 3
+			if flags&0x80 != 0 {
+				skip += 2
+			}
+			if flags&0x40 != 0 && len(data) > skip {
+				skip += 1 + int(data[skip])
+			}
+			if flags&0x20 != 0 {
+				skip += 2
+			}
+			if skip > len(data) {
+				return nil
+			}
+			data = data[skip:]
+		case 0x04: // DecoderConfigDescriptor
+			if len(data) < 13 {
+				return nil
+			}
+			data = data[13:]
+		case 0x05: // DecoderSpecificInfo
+			if size > len(data) {
+				return nil
+			}
+			return data[:size]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// writeTables 生成转封装使用的PAT和PMT
+func (fi *fmp4Init) writeTables() {
+	fi.pcrPID = fi.tracks[0].pid
+	for _, track := range fi.tracks {
+		if track.nalLength > 0 {
+			fi.pcrPID = track.pid
+			break
+		}
+	}
+	fi.pat = psiPacket(0, patSection(PID_FMP4_PMT))
+	pmt := pmtTable{pcrPID: fi.pcrPID}
+	for _, track := range fi.tracks {
+		pmt.streams = append(pmt.streams, pmtStream{pid: track.pid, streamType: track.streamType})
+	}
+	fi.pmt = psiPacket(PID_FMP4_PMT, pmt.section())
+}
+
+func (fi *fmp4Init) track(id uint32) *fmp4Track {
+	for _, track := range fi.tracks {
+		if track.id == id {
+			return track
+		}
+	}
+	return nil
+}
+
+// samples 解析媒体片段中所有 moof 和 mdat，按解码时间排序
+func (fi *fmp4Init) samples(data []byte) (samples []fmp4Sample, err error) {
+	err = rangeBoxes(data, func(typ string, moof []byte, moofOffset int) error {
+		if typ != "moof" {
+			return nil
+		}
+		return rangeBoxes(moof, func(typ string, traf []byte, _ int) error {
+			if typ != "traf" {
+				return nil
+			}
+			tfhd := findBox(traf, "tfhd")
+			if len(tfhd) < 8 {
+				return ErrInvalidFMP4
+			}
+			track := fi.track(binary.BigEndian.Uint32(tfhd[4:]))
+			if track == nil {
+				return nil
+			}
+			flags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+			base := uint64(moofOffset)
+			duration, size, sampleFlags := track.defaultDuration, track.defaultSize, track.defaultFlags
+			fields := tfhd[8:]
+			field := func() (v uint32) {
+				if len(fields) >= 4 {
+					v = binary.BigEndian.Uint32(fields)
+					fields = fields[4:]
+				}
+				return
+			}
+			if flags&0x01 != 0 && len(fields) >= 8 {
+				base = binary.BigEndian.Uint64(fields)
+				fields = fields[8:]
+			}
+			if flags&0x02 != 0 {
+				field()
+			}
+			if flags&0x08 != 0 {
+				duration = field()
+			}
+			if flags&0x10 != 0 {
+				size = field()
+			}
+			if flags&0x20 != 0 {
+				sampleFlags = field()
+			}
+			var decodeTime uint64
+			if tfdt := findBox(traf, "tfdt"); len(tfdt) >= 8 {
+				if tfdt[0] == 1 && len(tfdt) >= 12 {
+					decodeTime = binary.BigEndian.Uint64(tfdt[4:])
+				} else {
+					decodeTime = uint64(binary.BigEndian.Uint32(tfdt[4:]))
+				}
+			}
+			return rangeBoxes(traf, func(typ string, trun []byte, _ int) error {
+				if typ != "trun" {
+					return nil
+				}
+				if len(trun) < 8 {
+					return ErrInvalidFMP4
+				}
+				trunFlags := binary.BigEndian.Uint32(trun) & 0xffffff
+				count := binary.BigEndian.Uint32(trun[4:])
+				fields = trun[8:]
+				offset := base
+				if trunFlags&0x01 != 0 {
+					offset = base + uint64(int32(field()))
+				}
+				firstFlags, hasFirstFlags := uint32(0), trunFlags&0x04 != 0
+				if hasFirstFlags {
+					firstFlags = field()
+				}
+				for i := uint32(0); i < count; i++ {
+					d, s, f, cto := duration, size, sampleFlags, int64(0)
+					if trunFlags&0x100 != 0 {
+						d = field()
+					}
+					if trunFlags&0x200 != 0 {
+						s = field()
+					}
+					if trunFlags&0x400 != 0 {
+						f = field()
+					} else if i == 0 && hasFirstFlags {
+						f = firstFlags
+					}
+					if trunFlags&0x800 != 0 {
+						if v := field(); trun[0] == 0 {
+							cto = int64(v)
+						} else {
+							cto = int64(int32(v))
+						}
+					}
+					if offset+uint64(s) > uint64(len(data)) {
+						return ErrInvalidFMP4
+					}
+					dts := track.to90k(decodeTime)
+					samples = append(samples, fmp4Sample{
+						track: track,
+						dts:   dts,
+						pts:   uint64(int64(dts) + cto*90000/int64(track.timescale)),
+						key:   track.nalLength == 0 || f&0x10000 == 0,
+						data:  data[offset : offset+uint64(s)],
+					})
+					offset += uint64(s)
+					decodeTime += uint64(d)
+				}
+				base = offset
+				return nil
+			})
+		})
+	})
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].dts < samples[j].dts
+	})
+	return
+}
+
+// remux 把媒体片段转封装成ts
+func (fi *fmp4Init) remux(data []byte) (out []byte, err error) {
+	samples, err := fi.samples(data)
+	if err != nil {
+		return
+	}
+	out = make([]byte, 0, len(data)+len(data)/8)
+	out = fi.appendTable(out, 0, fi.pat)
+	out = fi.appendTable(out, PID_FMP4_PMT, fi.pmt)
+	for _, s := range samples {
+		track := s.track
+		var pes, es []byte
+		var af []byte
+		if track.nalLength > 0 {
+			if s.key {
+				for _, param := range track.params {
+					es = append(es, 0, 0, 0, 1)
+					es = append(es, param...)
+				}
+			}
+			for nalus := s.data; len(nalus) > track.nalLength; {
+				var l int
+				for _, b := range nalus[:track.nalLength] {
+					l = l<<8 | int(b)
+				}
+				nalus = nalus[track.nalLength:]
+				if l > len(nalus) {
+					return nil, ErrInvalidFMP4
+				}
+				es = append(es, 0, 0, 0, 1)
+				es = append(es, nalus[:l]...)
+				nalus = nalus[l:]
+			}
+			pes = append(pes, 0, 0, 1, STREAM_ID_VIDEO, 0, 0, 0x84, 0xc0, 10)
+			pes = appendPESTimestamp(pes, 0x30, s.pts)
+			pes = appendPESTimestamp(pes, 0x10, s.dts)
+			if s.key {
+				af = []byte{0x40}
+			}
+		} else {
+			l := 7 + len(s.data)
+			es = append(es, 0xff, 0xf1,
+				(track.profile-1)<<6|track.frequency<<2|track.channels>>2,
+				track.channels&0x03<<6|byte(l>>11),
+				byte(l>>3),
+				byte(l)<<5|0x1f,
+				0xfc)
+			es = append(es, s.data...)
+			pes = append(pes, 0, 0, 1, STREAM_ID_AUDIO, 0, 0, 0x84, 0x80, 5)
+			pes = appendPESTimestamp(pes, 0x20, s.pts)
+		}
+		if l := len(pes) - 6 + len(es); l <= 0xffff {
+			pes[4], pes[5] = byte(l>>8), byte(l)
+		}
+		if track.pid == fi.pcrPID {
+			if af == nil {
+				af = []byte{0}
+			}
+			af[0] |= 0x10
+			pcr := s.dts
+			af = append(af, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7e, 0)
+		}
+		c := fi.counter(track.pid)
+		out = packetizePES(out, track.pid, af, append(pes, es...), &c)
+		fi.cc[track.pid] = c
+	}
+	return
+}
+
+// counter 返回 pid 上一个ts包的 continuity_counter，第一个包从0开始
+func (fi *fmp4Init) counter(pid uint16) byte {
+	if c, ok := fi.cc[pid]; ok {
+		return c
+	}
+	return 0x0f
+}
+
+// appendTable 输出PAT或PMT，continuity_counter 接着上一个切片
+func (fi *fmp4Init) appendTable(out []byte, pid uint16, packet []byte) []byte {
+	c := (fi.counter(pid) + 1) & 0x0f
+	fi.cc[pid] = c
+	out = append(out, packet...)
+	out[len(out)-len(packet)+3] = packet[3]&0xf0 | c
+	return out
+}
+
+func appendPESTimestamp(b []byte, prefix byte, ts uint64) []byte {
+	return append(b,
+		prefix|byte(ts>>29)&0x0e|1,
+		byte(ts>>22),
+		byte(ts>>14)&0xfe|1,
+		byte(ts>>7),
+		byte(ts<<1)&0xfe|1)
+}
+
+// fmp4Reader 下载时只把fMP4切片读入内存，第一次读取时才转封装。
+// 切片是并发下载但按顺序读取的，这样 continuity_counter 才能跨切片连续
+type fmp4Reader struct {
+	io.Closer
+	fi   *fmp4Init
+	data []byte
+	ts   *bytes.Reader
+	err  error
+}
+
+func newFMP4Reader(body io.ReadCloser, fi *fmp4Init) (io.ReadCloser, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return &fmp4Reader{Closer: body, fi: fi, data: data}, nil
+}
+
+func (r *fmp4Reader) Read(b []byte) (int, error) {
+	if r.ts == nil && r.err == nil {
+		var data []byte
+		if data, r.err = r.fi.remux(r.data); r.err == nil {
+			r.ts = bytes.NewReader(data)
+		}
+		r.data = nil
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.ts.Read(b)
+}
+
+// fmp4Inits 拉流时缓存当前使用的初始化片段
+type fmp4Inits struct {
+	id      string
+	current *fmp4Init
+}
+
+// get 返回 #EXT-X-MAP 对应的初始化片段，aesKey 不为空时初始化片段也使用 AES-128 加密
+func (c *fmp4Inits) get(p *HLSPuller, client *http.Client, base *http.Request, m *m3u8.Map, key *m3u8.Key, aesKey, iv []byte) (fi *fmp4Init, err error) {
+	if m == nil {
+		return
+	}
+	mapURL, err := base.URL.Parse(m.URI)
+	if err != nil {
+		return
+	}
+	id := mapURL.String()
+	if m.ByteRange != nil {
+		id += "@" + m.ByteRange.String()
+	}
+	if id == c.id {
+		return c.current, nil
+	}
+	data, err := fetchBytes(p.Context, client, mapURL.String(), rangeHeader(p.TsHead, m.ByteRange), maxInitSize)
+	if err != nil {
+		return
+	}
+	if aesKey != nil && key.Method == m3u8.KEY_METHOD_AES_128 {
+		var r io.ReadCloser
+		if r, err = newAESReader(io.NopCloser(bytes.NewReader(data)), aesKey, iv); err != nil {
+			return
+		}
+		if data, err = io.ReadAll(r); err != nil {
+			return
+		}
+	}
+	if fi, err = parseFMP4Init(data); err == nil {
+		for _, reason := range fi.skipped {
+			HLSPlugin.Warn("skip fmp4 track", zap.String("streamPath", p.Stream.Path), zap.Error(reason))
+		}
+		if c.current != nil {
+			// 换了初始化片段，PID 不变，计数继续
+			fi.cc = c.current.cc
+		}
+		c.id, c.current = id, fi
+	}
+	return
+}
+
+// open 解密切片，fMP4 切片再转封装成ts
+func (p *TSDownloader) open(body io.ReadCloser) (io.ReadCloser, error) {
+	body, err := p.decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	if p.fmp4 != nil {
+		return newFMP4Reader(body, p.fmp4)
+	}
+	if _, ok := body.(memoryBody); p.buffered && !ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		return memoryBody{bytes.NewReader(data), body}, nil
+	}
+	return body, nil
+}
@@ -0,0 +1,237 @@
+package hls
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	data := concat(payload...)
+	return concat(u32(uint32(8+len(data))), []byte(typ), data)
+}
+
+func u32(v ...uint32) (b []byte) {
+	b = make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(b[4*i:], x)
+	}
+	return
+}
+
+var (
+	testSPS = unhex("6742c01e95a0")
+	testPPS = unhex("68ce3c80")
+)
+
+// testInit 一个 H.264 轨道（timescale 90000）和一个 AAC 轨道（timescale 48000）
+func testInit() []byte {
+	esds := concat(u32(0), []byte{0x03, 22, 0, 1, 0}, []byte{0x04, 17, 0x40, 0x15}, make([]byte, 11), []byte{0x05, 2, 0x11, 0x90})
+	return testInitWith(box("mp4a", make([]byte, 28), box("esds", esds)))
+}
+
+// testInitWith 一个 H.264 轨道和一个使用 audio 作为 sample entry 的音频轨道
+func testInitWith(audio []byte) []byte {
+	trak := func(id, timescale uint32, entry []byte) []byte {
+		return box("trak",
+			box("tkhd", u32(0, 0, 0, id), make([]byte, 68)),
+			box("mdia",
+				box("mdhd", u32(0, 0, 0, timescale, 0, 0)),
+				box("minf", box("stbl", box("stsd", u32(0, 1), entry)))))
+	}
+	avcC := concat([]byte{1, 0x42, 0xc0, 0x1e, 0xff, 0xe1, 0, byte(len(testSPS))}, testSPS, []byte{1, 0, byte(len(testPPS))}, testPPS)
+	return concat(
+		box("ftyp", []byte("iso6"), u32(0)),
+		box("moov",
+			box("mvhd", make([]byte, 100)),
+			trak(1, 90000, box("avc1", make([]byte, 78), box("avcC", avcC))),
+			trak(2, 48000, audio),
+			box("mvex",
+				box("trex", u32(0, 1, 1, 3000, 0, 0)),
+				box("trex", u32(0, 2, 1, 1024, 0, 0)))))
+}
+
+// testFragment 两帧视频（关键帧和P帧，第二帧 cto 为3000）和两帧音频
+func testFragment(videoTime, audioTime uint64) []byte {
+	idr := concat(u32(8), unhex("65888400aabbccdd"))
+	p := concat(u32(5), unhex("419a0011ee"))
+	aac := [][]byte{unhex("211002"), unhex("21100304")}
+	moof := func(videoOffset, audioOffset uint32) []byte {
+		return box("moof",
+			box("mfhd", u32(0, 1)),
+			box("traf",
+				box("tfhd", u32(0x020000, 1)),
+				box("tfdt", u32(1<<24, uint32(videoTime>>32), uint32(videoTime))),
+				box("trun", u32(0x000f01, 2, videoOffset,
+					3000, uint32(len(idr)), 0, 0,
+					3000, uint32(len(p)), 0x10000, 3000))),
+			box("traf",
+				box("tfhd", u32(0x020000, 2)),
+				box("tfdt", u32(1<<24, uint32(audioTime>>32), uint32(audioTime))),
+				box("trun", u32(0x000201, 2, audioOffset, uint32(len(aac[0])), uint32(len(aac[1]))))))
+	}
+	size := uint32(len(moof(0, 0))) + 8
+	return concat(moof(size, size+uint32(len(idr)+len(p))), box("mdat", idr, p, aac[0], aac[1]))
+}
+
+func TestFMP4Samples(t *testing.T) {
+	fi, err := parseFMP4Init(testInit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fi.tracks) != 2 {
+		t.Fatalf("got %d tracks", len(fi.tracks))
+	}
+	video, audio := fi.tracks[0], fi.tracks[1]
+	if video.streamType != mpegts.STREAM_TYPE_H264 || video.nalLength != 4 || len(video.params) != 2 || !bytes.Equal(video.params[0], testSPS) || !bytes.Equal(video.params[1], testPPS) {
+		t.Errorf("video track %+v", video)
+	}
+	if audio.streamType != mpegts.STREAM_TYPE_AAC || audio.profile != 2 || audio.frequency != 3 || audio.channels != 2 || audio.defaultDuration != 1024 {
+		t.Errorf("audio track %+v", audio)
+	}
+	samples, err := fi.samples(testFragment(90000, 48000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		track    *fmp4Track
+		dts, pts uint64
+		key      bool
+	}{
+		{video, 90000, 90000, true},
+		{audio, 90000, 90000, true},
+		{audio, 91920, 91920, true},
+		{video, 93000, 96000, false},
+	}
+	if len(samples) != len(want) {
+		t.Fatalf("got %d samples", len(samples))
+	}
+	// 按解码时间排序，相同时保持轨道顺序
+	for i, w := range want {
+		if s := samples[i]; s.track != w.track || s.dts != w.dts || s.pts != w.pts || s.key != w.key {
+			t.Errorf("sample %d: got track %d dts %d pts %d key %v", i, s.track.id, s.dts, s.pts, s.key)
+		}
+	}
+}
+
+func TestFMP4SkipsOpus(t *testing.T) {
+	fi, err := parseFMP4Init(testInitWith(box("Opus", make([]byte, 28), box("dOps", []byte{0, 2, 0x01, 0x38, 0, 0, 0xbb, 0x80, 0, 0, 0}))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Opus 轨道被跳过并记录原因，只发布视频
+	if len(fi.tracks) != 1 || fi.tracks[0].streamType != mpegts.STREAM_TYPE_H264 {
+		t.Fatalf("got %d tracks", len(fi.tracks))
+	}
+	if len(fi.skipped) != 1 || !errors.Is(fi.skipped[0], ErrUnsupportedFMP4Track) {
+		t.Errorf("skipped %v", fi.skipped)
+	}
+	pmt, ok := parsePMT(psiSection(fi.pmt[4:]))
+	if !ok || len(pmt.streams) != 1 || pmt.streams[0].pid != PID_FMP4_START {
+		t.Errorf("PMT %+v", pmt)
+	}
+}
+
+func TestFMP4HEAAC(t *testing.T) {
+	tests := []struct {
+		name                string
+		asc                 []byte
+		frequency, channels byte
+	}{
+		// AOT 5，核心采样率 24000，扩展采样率 48000，基础为 AAC-LC
+		{"SBR", unhex("2b118800"), 6, 2},
+		// AOT 29，单声道
+		{"PS", unhex("eb098800"), 6, 1},
+	}
+	for _, tt := range tests {
+		esds := concat(u32(0), []byte{0x03, 24, 0, 1, 0}, []byte{0x04, 19, 0x40, 0x15}, make([]byte, 11), []byte{0x05, byte(len(tt.asc))}, tt.asc)
+		fi, err := parseFMP4Init(testInitWith(box("mp4a", make([]byte, 28), box("esds", esds))))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(fi.tracks) != 2 {
+			t.Fatalf("%s: got %d tracks, skipped %v", tt.name, len(fi.tracks), fi.skipped)
+		}
+		if audio := fi.tracks[1]; audio.profile != 2 || audio.frequency != tt.frequency || audio.channels != tt.channels {
+			t.Errorf("%s: audio track %+v", tt.name, audio)
+		}
+	}
+}
+
+// tsPackets 按PID拆分ts包，检查 continuity_counter 是否连续
+func tsPackets(t *testing.T, data []byte, cc map[uint16]byte) map[uint16][][]byte {
+	t.Helper()
+	packets := make(map[uint16][][]byte)
+	if len(data)%188 != 0 {
+		t.Fatalf("ts size %d", len(data))
+	}
+	for ; len(data) > 0; data = data[188:] {
+		packet := data[:188]
+		if packet[0] != 0x47 {
+			t.Fatalf("bad sync byte %#x", packet[0])
+		}
+		pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+		c := packet[3] & 0x0f
+		if last, ok := cc[pid]; ok && c != (last+1)&0x0f {
+			t.Errorf("pid %#x: continuity counter %d after %d", pid, c, last)
+		}
+		cc[pid] = c
+		packets[pid] = append(packets[pid], packet)
+	}
+	return packets
+}
+
+func TestFMP4Remux(t *testing.T) {
+	fi, err := parseFMP4Init(testInit())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := make(map[uint16]byte)
+	for i, fragment := range [][]byte{testFragment(90000, 48000), testFragment(96000, 50048)} {
+		out, err := fi.remux(fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets := tsPackets(t, out, cc)
+		// 转封装后的切片接着上一个切片计数
+		if c := out[3] & 0x0f; c != byte(i) {
+			t.Errorf("segment %d: PAT continuity counter %d", i, c)
+		}
+		if n := len(packets[0]) + len(packets[PID_FMP4_PMT]); n != 2 {
+			t.Errorf("segment %d: %d PSI packets", i, n)
+		}
+		if n := len(packets[PID_FMP4_START]); n != 2 {
+			t.Errorf("segment %d: %d video packets", i, n)
+		}
+		if n := len(packets[PID_FMP4_START+1]); n != 2 {
+			t.Errorf("segment %d: %d audio packets", i, n)
+		}
+		if i > 0 {
+			continue
+		}
+		// 关键帧前加上 SPS 和 PPS，并带有PCR
+		first := packets[PID_FMP4_START][0]
+		if first[1]&0x40 == 0 || first[3]&0x20 == 0 || first[5]&0x50 != 0x50 {
+			t.Errorf("first video packet header %x", first[:6])
+		}
+		payload := first[5+int(first[4]):]
+		es := payload[9+int(payload[8]):]
+		if want := concat(unhex("00000001"), testSPS, unhex("00000001"), testPPS, unhex("00000001"), unhex("65888400aabbccdd")); !bytes.Equal(es, want) {
+			t.Errorf("video es %x, want %x", es, want)
+		}
+		audio := packets[PID_FMP4_START+1][0]
+		payload = audio[5+int(audio[4]):]
+		es = payload[9+int(payload[8]):]
+		if want := concat(adtsHeader(2, 3, 2, 3), unhex("211002")); !bytes.Equal(es, want) {
+			t.Errorf("audio es %x, want %x", es, want)
+		}
+	}
+}
+
+func adtsHeader(profile, frequency, channels byte, size int) []byte {
+	l := 7 + size
+	return []byte{0xff, 0xf1, (profile-1)<<6 | frequency<<2 | channels>>2, channels&0x03<<6 | byte(l>>11), byte(l >> 3), byte(l)<<5 | 0x1f, 0xfc}
+}
@@ -1,12 +1,15 @@
 package hls
 
 import (
-	"fmt"
 	"io"
+	"time"
+
+	"m7s.live/plugin/hls/v4/m3u8"
 )
 
 const (
-	HLS_KEY_METHOD_AES_128 = "AES-128"
+	HLS_KEY_METHOD_AES_128   = m3u8.KEY_METHOD_AES_128
+	PROGRAM_DATE_TIME_FORMAT = m3u8.DATE_TIME_FORMAT
 )
 
 // https://datatracker.ietf.org/doc/draft-pantos-http-live-streaming/
@@ -14,16 +17,18 @@ const (
 // 以”#EXT“开头的表示一个”tag“,否则表示注释,直接忽略
 type Playlist struct {
 	io.Writer
-	ExtM3U         string      // indicates that the file is an Extended M3U [M3U] Playlist file. (4.3.3.1) -- 每个M3U文件第一行必须是这个tag.
-	Version        int         // indicates the compatibility version of the Playlist file. (4.3.1.2) -- 协议版本号.
-	Sequence       int         // indicates the Media Sequence Number of the first Media Segment that appears in a Playlist file. (4.3.3.2) -- 第一个媒体段的序列号.
-	Targetduration int         // specifies the maximum Media Segment duration. (4.3.3.1) -- 每个视频分段最大的时长(单位秒).
-	PlaylistType   int         // rovides mutability information about the Media Playlist file. (4.3.3.5) -- 提供关于PlayList的可变性的信息.
-	Discontinuity  int         // indicates a discontinuity between theMedia Segment that follows it and the one that preceded it. (4.3.2.3) -- 该标签后边的媒体文件和之前的媒体文件之间的编码不连贯(即发生改变)(场景用于插播广告等等).
-	Key            PlaylistKey // specifies how to decrypt them. (4.3.2.4) -- 解密媒体文件的必要信息(表示怎么对media segments进行解码).
-	EndList        string      // indicates that no more Media Segments will be added to the Media Playlist file. (4.3.3.4) -- 标示没有更多媒体文件将会加入到播放列表中,它可能会出现在播放列表文件的任何地方,但是不能出现两次或以上.
-	Inf            PlaylistInf // specifies the duration of a Media Segment. (4.3.2.1) -- 指定每个媒体段(ts)的持续时间.
-	tsCount        int
+	ExtM3U          string      // indicates that the file is an Extended M3U [M3U] Playlist file. (4.3.3.1) -- 每个M3U文件第一行必须是这个tag.
+	Version         int         // indicates the compatibility version of the Playlist file. (4.3.1.2) -- 协议版本号.
+	Sequence        int         // indicates the Media Sequence Number of the first Media Segment that appears in a Playlist file. (4.3.3.2) -- 第一个媒体段的序列号.
+	Targetduration  int         // specifies the maximum Media Segment duration. (4.3.3.1) -- 每个视频分段最大的时长(单位秒).
+	PlaylistType    int         // rovides mutability information about the Media Playlist file. (4.3.3.5) -- 提供关于PlayList的可变性的信息.
+	Discontinuity   int         // indicates a discontinuity between theMedia Segment that follows it and the one that preceded it. (4.3.2.3) -- 该标签后边的媒体文件和之前的媒体文件之间的编码不连贯(即发生改变)(场景用于插播广告等等).
+	Key             PlaylistKey // specifies how to decrypt them. (4.3.2.4) -- 解密媒体文件的必要信息(表示怎么对media segments进行解码).
+	EndList         string      // indicates that no more Media Segments will be added to the Media Playlist file. (4.3.3.4) -- 标示没有更多媒体文件将会加入到播放列表中,它可能会出现在播放列表文件的任何地方,但是不能出现两次或以上.
+	Inf             PlaylistInf // specifies the duration of a Media Segment. (4.3.2.1) -- 指定每个媒体段(ts)的持续时间.
+	tsCount         int
+	discontinuities int         // 自上次 Init 以来输出的 #EXT-X-DISCONTINUITY 数
+	carried         PlaylistInf // 被替换且没有替换切片的条目的标签，写在下一个输出的切片之前
 }
 
 // Discontinuity :
@@ -43,28 +48,122 @@ type PlaylistInf struct {
 	Duration float64
 	Title    string
 	FilePath string
+	Length   int64 // 大于0时输出 #EXT-X-BYTERANGE，Title 所指的文件中从 Offset 开始的 Length 个字节
+	Offset   int64
+	// 不为零时输出 #EXT-X-PROGRAM-DATE-TIME
+	ProgramDateTime time.Time
+	DateRanges      []*m3u8.DateRange
+	Tags            []string // 其他写在 #EXTINF 之前的标签，例如 #EXT-X-CUE-OUT
+	// 该切片之前与上一个切片不连续
+	Discontinuity bool
+	// Replaced 为 true 时不输出该切片，而是输出 Substitute 中的切片（可以为空），用于插播
+	Replaced   bool
+	Substitute []PlaylistInf
+}
+
+// Segments 返回该条目在播放列表中实际输出的切片，被替换时自身的标签写在第一个替换切片之前，没有替换切片时由 WriteInf 写在下一个切片之前
+func (inf *PlaylistInf) Segments() (segments []*m3u8.Segment) {
+	if !inf.Replaced {
+		segment := &m3u8.Segment{
+			URI:             inf.Title,
+			Duration:        inf.Duration,
+			Discontinuity:   inf.Discontinuity,
+			ProgramDateTime: inf.ProgramDateTime,
+			DateRanges:      inf.DateRanges,
+			Tags:            inf.Tags,
+		}
+		if inf.Length > 0 {
+			segment.ByteRange = &m3u8.ByteRange{Length: inf.Length, Offset: inf.Offset}
+		}
+		return []*m3u8.Segment{segment}
+	}
+	for i := range inf.Substitute {
+		segments = append(segments, inf.Substitute[i].Segments()...)
+	}
+	if len(segments) > 0 {
+		segments[0] = inf.prependTo(segments[0])
+	}
+	return
+}
+
+// prependTo 返回加上了该条目的时间和标签的切片副本
+func (inf *PlaylistInf) prependTo(segment *m3u8.Segment) *m3u8.Segment {
+	s := *segment
+	if s.ProgramDateTime.IsZero() {
+		s.ProgramDateTime = inf.ProgramDateTime
+	}
+	s.DateRanges = append(inf.DateRanges[:len(inf.DateRanges):len(inf.DateRanges)], s.DateRanges...)
+	s.Tags = append(inf.Tags[:len(inf.Tags):len(inf.Tags)], s.Tags...)
+	return &s
+}
+
+// carry 条目没有输出任何切片时保留它的标签，时间顺延到下一个切片的开始
+func (pl *Playlist) carry(inf *PlaylistInf) {
+	c := &pl.carried
+	c.DateRanges = append(c.DateRanges, inf.DateRanges...)
+	c.Tags = append(c.Tags, inf.Tags...)
+	if !inf.ProgramDateTime.IsZero() {
+		c.ProgramDateTime = inf.ProgramDateTime
+	}
+	if !c.ProgramDateTime.IsZero() {
+		c.ProgramDateTime = c.ProgramDateTime.Add(time.Duration(inf.Duration * float64(time.Second)))
+	}
+}
+
+// Count 返回该条目在播放列表中实际输出的切片数和 #EXT-X-DISCONTINUITY 数
+func (inf *PlaylistInf) Count() (segments int, discontinuities int) {
+	for _, s := range inf.Segments() {
+		segments++
+		if s.Discontinuity {
+			discontinuities++
+		}
+	}
+	return
 }
 
 func (pl *Playlist) Init() (err error) {
-	// ss := fmt.Sprintf("#EXTM3U\n"+
-	// 	"#EXT-X-VERSION:%d\n"+
-	// 	"#EXT-X-MEDIA-SEQUENCE:%d\n"+
-	// 	"#EXT-X-TARGETDURATION:%d\n"+
-	// 	"#EXT-X-PLAYLIST-TYPE:%d\n"+
-	// 	"#EXT-X-DISCONTINUITY:%d\n"+
-	// 	"#EXT-X-KEY:METHOD=%s,URI=%s,IV=%s\n"+
-	// 	"#EXT-X-ENDLIST", hls.Version, hls.Sequence, hls.Targetduration, hls.PlaylistType, hls.Discontinuity, hls.Key.Method, hls.Key.Uri, hls.Key.IV)
-	_, err = fmt.Fprintf(pl, "#EXTM3U\n"+
-		"#EXT-X-VERSION:%d\n"+
-		"#EXT-X-MEDIA-SEQUENCE:%d\n"+
-		"#EXT-X-TARGETDURATION:%d\n", pl.Version, pl.Sequence, pl.Targetduration)
+	header := m3u8.MediaPlaylist{
+		Version:               pl.Version,
+		TargetDuration:        pl.Targetduration,
+		MediaSequence:         pl.Sequence,
+		DiscontinuitySequence: pl.Discontinuity,
+	}
+	err = header.EncodeHeader(pl)
 	pl.Sequence++
+	pl.tsCount = 0
+	pl.discontinuities = 0
+	pl.carried = PlaylistInf{}
 	return
 }
 
+// Next 返回播放列表中最后一个切片之后的媒体序号和不连续序号
+func (pl *Playlist) Next() (sequence int, discontinuity int) {
+	return pl.Sequence - 1 + pl.tsCount, pl.Discontinuity + pl.discontinuities
+}
+
 func (pl *Playlist) WriteInf(inf PlaylistInf) (err error) {
-	_, err = fmt.Fprintf(pl, "#EXTINF:%.3f,\n"+
-		"%s\n", inf.Duration, inf.Title)
-	pl.tsCount++
+	segments := inf.Segments()
+	if len(segments) == 0 {
+		pl.carry(&inf)
+		return
+	}
+	if c := &pl.carried; len(c.DateRanges) > 0 || len(c.Tags) > 0 {
+		segments[0] = c.prependTo(segments[0])
+	}
+	pl.carried = PlaylistInf{}
+	for _, segment := range segments {
+		if err = segment.Encode(pl); err != nil {
+			return
+		}
+		pl.tsCount++
+		if segment.Discontinuity {
+			pl.discontinuities++
+		}
+	}
+	return
+}
+
+func (pl *Playlist) WriteEndList() (err error) {
+	_, err = io.WriteString(pl, "#EXT-X-ENDLIST\n")
 	return
 }
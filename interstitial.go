@@ -0,0 +1,141 @@
+package hls
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// https://developer.apple.com/streaming/GettingStartedWithHLSInterstitials.pdf
+
+// Interstitial Apple HLS Interstitials，输出为 CLASS="com.apple.hls.interstitial" 的 #EXT-X-DATERANGE
+type Interstitial struct {
+	ID           string
+	StartDate    time.Time
+	Duration     time.Duration  // 可选
+	AssetURI     string         // X-ASSET-URI，与 AssetList 二选一
+	AssetList    string         // X-ASSET-LIST
+	ResumeOffset *time.Duration // X-RESUME-OFFSET，为空时由播放器决定
+	Restrict     string         // X-RESTRICT，例如 SKIP,JUMP
+	Cue          string         // CUE，例如 PRE、POST、ONCE
+}
+
+var interstitialID uint32
+
+type trackInterstitial struct {
+	*Interstitial
+	start time.Duration
+}
+
+// ScheduleInterstitial 为正在写入的HLS流安排一个插播内容，供其他插件调用
+func ScheduleInterstitial(streamPath string, i *Interstitial) error {
+	if hls, ok := memoryTs.Get(streamPath).(*HLSWriter); ok {
+		hls.ScheduleInterstitial(i)
+		return nil
+	}
+	return ErrNoHLSWriter
+}
+
+func (hls *HLSWriter) ScheduleInterstitial(i *Interstitial) {
+	if i.ID == "" {
+		i.ID = fmt.Sprintf("interstitial-%d", atomic.AddUint32(&interstitialID, 1))
+	}
+	now := time.Now()
+	var offset time.Duration
+	if i.StartDate.After(now) {
+		offset = i.StartDate.Sub(now)
+	}
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	for _, t := range hls.video_tracks {
+		t.interstitials = append(t.interstitials, &trackInterstitial{i, t.timestamp + offset})
+	}
+	for _, t := range hls.audio_tracks {
+		t.interstitials = append(t.interstitials, &trackInterstitial{i, t.timestamp + offset})
+	}
+}
+
+// interstitialDateRanges 返回从 ts 开始的切片之前需要输出的插播内容，START-DATE 与该切片的 PROGRAM-DATE-TIME 一致
+func (t *TrackReader) interstitialDateRanges(ts time.Duration, date time.Time) (dateRanges []*m3u8.DateRange) {
+	remain := t.interstitials[:0]
+	for _, i := range t.interstitials {
+		if ts < i.start {
+			remain = append(remain, i)
+			continue
+		}
+		d := &m3u8.DateRange{
+			ID:        i.ID,
+			Class:     "com.apple.hls.interstitial",
+			StartDate: date,
+			Cue:       i.Cue,
+			Duration:  i.Duration.Seconds(),
+		}
+		if i.AssetList != "" {
+			d.ClientAttributes = append(d.ClientAttributes, m3u8.Attribute{Name: "X-ASSET-LIST", Value: `"` + i.AssetList + `"`})
+		} else {
+			d.ClientAttributes = append(d.ClientAttributes, m3u8.Attribute{Name: "X-ASSET-URI", Value: `"` + i.AssetURI + `"`})
+		}
+		if i.ResumeOffset != nil {
+			d.ClientAttributes = append(d.ClientAttributes, m3u8.Attribute{Name: "X-RESUME-OFFSET", Value: fmt.Sprintf("%.3f", i.ResumeOffset.Seconds())})
+		}
+		if i.Restrict != "" {
+			d.ClientAttributes = append(d.ClientAttributes, m3u8.Attribute{Name: "X-RESTRICT", Value: `"` + i.Restrict + `"`})
+		}
+		dateRanges = append(dateRanges, d)
+	}
+	t.interstitials = remain
+	return
+}
+
+// API_Interstitial 安排插播内容，uri 或 list 指定插播资源，可选 start（RFC3339）、duration、resume、restrict、cue、id
+func (config *HLSConfig) API_Interstitial(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	i := &Interstitial{
+		ID:        query.Get("id"),
+		AssetURI:  query.Get("uri"),
+		AssetList: query.Get("list"),
+		Restrict:  query.Get("restrict"),
+		Cue:       query.Get("cue"),
+	}
+	if (i.AssetURI == "") == (i.AssetList == "") {
+		util.ReturnError(util.APIErrorQueryParse, "one of uri and list required", w, r)
+		return
+	}
+	for _, v := range []string{i.ID, i.AssetURI, i.AssetList, i.Restrict, i.Cue} {
+		if strings.ContainsAny(v, "\"\r\n") {
+			util.ReturnError(util.APIErrorQueryParse, "invalid attribute", w, r)
+			return
+		}
+	}
+	var err error
+	if start := query.Get("start"); start != "" {
+		if i.StartDate, err = time.Parse(time.RFC3339, start); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+	}
+	if duration := query.Get("duration"); duration != "" {
+		if i.Duration, err = time.ParseDuration(duration); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+	}
+	if resume := query.Get("resume"); resume != "" {
+		offset, err := time.ParseDuration(resume)
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+		i.ResumeOffset = &offset
+	}
+	if err = ScheduleInterstitial(query.Get("streamPath"), i); err != nil {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
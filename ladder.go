@@ -0,0 +1,232 @@
+package hls
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+const maxMasterSize = 4 << 20 // 主播放列表的大小上限
+
+// variantLadder 把主播放列表的每个变体拉成 streamPath/名称 的流，并生成引用这些流的主播放列表
+type variantLadder struct {
+	streamPath string
+	variants   []*ladderVariant
+	start      time.Time
+}
+
+type ladderVariant struct {
+	*m3u8.Variant // 上游的变体，用于提供码率和编码信息
+	name          string
+	streamPath    string
+}
+
+// pullStream 策略为 all 时在后台获取主播放列表并拉取所有变体，否则按普通方式拉流
+func pullStream(streamPath, url string, puller *HLSPuller, save int) error {
+	if puller.variantPolicy() == VARIANT_ALL {
+		// 获取主播放列表可能很慢，不能阻塞事件分发和 API
+		go func() {
+			if err := pullVariants(streamPath, url, puller, save); err != nil {
+				HLSPlugin.Error("pull variants", zap.String("streamPath", streamPath), zap.String("url", url), zap.Error(err))
+			}
+		}()
+		return nil
+	}
+	return startPull(streamPath, url, puller, save)
+}
+
+// invitePull 按需拉流，订阅者等待的是 streamPath 本身，所以只拉取一路发布在 streamPath，策略为 all 时同 highest
+func invitePull(streamPath, url string, puller *HLSPuller) error {
+	return startPull(streamPath, url, puller, 0)
+}
+
+func pullVariants(streamPath, masterURL string, puller *HLSPuller, save int) (err error) {
+	client, err := newPullClient(hlsConfig.Pull.Proxy)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	data, err := fetchBytes(ctx, client, masterURL, puller.TsHead, maxMasterSize)
+	if err != nil {
+		return
+	}
+	playlist, err := m3u8.ReadBytes(data)
+	if err != nil {
+		return
+	}
+	master, ok := playlist.(*m3u8.MasterPlaylist)
+	if !ok {
+		// 不是主播放列表，只有一个变体
+		return startPull(streamPath, masterURL, puller, save)
+	}
+	ladder := &variantLadder{streamPath: strings.Split(streamPath, "?")[0], start: time.Now()}
+	names := make(map[string]bool)
+	for i, v := range master.Variants {
+		if v.IFrame {
+			continue
+		}
+		name := variantName(v, i, names)
+		child := &HLSPuller{
+			TsHead:     puller.TsHead,
+			Loop:       puller.Loop,
+			Variant:    VARIANT_URI + ":" + v.URI,
+			Language:   puller.Language,
+			MultiAudio: puller.MultiAudio,
+			Retry:      puller.Retry,
+		}
+		childPath := ladder.streamPath + "/" + name
+		if err := startPull(childPath, masterURL, child, save); err != nil {
+			HLSPlugin.Error("pull variant", zap.String("streamPath", childPath), zap.Error(err))
+			continue
+		}
+		ladder.variants = append(ladder.variants, &ladderVariant{Variant: v, name: name, streamPath: childPath})
+	}
+	if len(ladder.variants) == 0 {
+		return ErrNoVariant
+	}
+	HLSPlugin.Info("pull variants", zap.String("streamPath", ladder.streamPath), zap.Int("count", len(ladder.variants)))
+	memoryM3u8.Store(ladder.streamPath, ladder)
+	hlsNotifier.Notify(ladder.streamPath)
+	go ladder.watch()
+	return
+}
+
+// variantName 优先使用 NAME 属性，其次是分辨率的高度，重名时加上序号
+func variantName(v *m3u8.Variant, i int, names map[string]bool) (name string) {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '?' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, v.Name)
+	if name == "" && v.Height > 0 {
+		name = strconv.Itoa(v.Height) + "p"
+	}
+	if name == "" {
+		name = "v" + strconv.Itoa(i)
+	} else if names[name] {
+		name += "_" + strconv.Itoa(i)
+	}
+	names[name] = true
+	return
+}
+
+// watch 所有变体的流都结束后删除主播放列表
+func (l *variantLadder) watch() {
+	for seen := false; ; time.Sleep(time.Second * 5) {
+		alive := false
+		for _, v := range l.variants {
+			if Streams.Get(v.streamPath) != nil {
+				alive = true
+			}
+		}
+		if alive {
+			seen = true
+		} else if seen || time.Since(l.start) > time.Minute {
+			break
+		}
+	}
+	if v, ok := memoryM3u8.Load(l.streamPath); ok && v == l {
+		memoryM3u8.Delete(l.streamPath)
+	}
+	hlsNotifier.Notify(l.streamPath)
+	HLSPlugin.Info("variants end", zap.String("streamPath", l.streamPath))
+}
+
+// invite 非预加载时为还没有播放列表的变体启动写入
+func (l *variantLadder) invite(rawQuery string) {
+	if hlsConfig.Preload {
+		return
+	}
+	for _, v := range l.variants {
+		if _, ok := memoryM3u8.Load(v.streamPath); ok {
+			continue
+		}
+		if writer, loaded := writingMap.LoadOrStore(v.streamPath, new(HLSWriter)); !loaded {
+			go writer.(*HLSWriter).Start(v.streamPath + "?" + rawQuery)
+		}
+	}
+}
+
+// master 合并各个变体的主播放列表，所有变体就绪或 partial 时有任意变体就绪则返回
+func (l *variantLadder) master(partial bool) (string, bool) {
+	master := m3u8.MasterPlaylist{Version: 4}
+	ready := 0
+	for _, v := range l.variants {
+		value, ok := memoryM3u8.Load(v.streamPath)
+		if !ok {
+			continue
+		}
+		playlist, ok := value.(string)
+		if !ok {
+			continue
+		}
+		pl, err := m3u8.ReadBytes([]byte(playlist))
+		if err != nil {
+			continue
+		}
+		ready++
+		switch pl := pl.(type) {
+		case *m3u8.MediaPlaylist:
+			// 纯转发时变体的流只有媒体播放列表，地址与主播放列表同样相对于应用目录
+			_, streamName, _ := strings.Cut(v.streamPath, "/")
+			master.Variants = append(master.Variants, v.local(&m3u8.Variant{URI: streamName + ".m3u8?sub=1"}))
+		case *m3u8.MasterPlaylist:
+			if pl.Version > master.Version {
+				master.Version = pl.Version
+			}
+			group := func(id string) string {
+				if id == "" || id == "NONE" {
+					return id
+				}
+				return id + "_" + v.name
+			}
+			for _, r := range pl.Renditions {
+				r.GroupID = group(r.GroupID)
+				master.Renditions = append(master.Renditions, r)
+			}
+			for _, variant := range pl.Variants {
+				variant.Audio, variant.Video = group(variant.Audio), group(variant.Video)
+				variant.Subtitles, variant.ClosedCaptions = group(variant.Subtitles), group(variant.ClosedCaptions)
+				if !variant.IFrame {
+					variant = v.local(variant)
+				}
+				master.Variants = append(master.Variants, variant)
+			}
+		}
+	}
+	if ready == 0 || ready < len(l.variants) && !partial {
+		return "", false
+	}
+	return master.String(), true
+}
+
+// local 用上游变体的码率、编码和分辨率描述本地的变体
+func (v *ladderVariant) local(variant *m3u8.Variant) *m3u8.Variant {
+	variant.Name = v.name
+	variant.Bandwidth = v.Bandwidth
+	variant.AverageBandwidth = v.AverageBandwidth
+	variant.Codecs = v.Codecs
+	variant.FrameRate = v.FrameRate
+	if v.Width > 0 {
+		variant.Width, variant.Height = v.Width, v.Height
+	}
+	return variant
+}
+
+// notifyLadder 变体的播放列表更新时唤醒等待主播放列表的请求
+func notifyLadder(streamPath string) {
+	parent := path.Dir(streamPath)
+	if v, ok := memoryM3u8.Load(parent); ok {
+		if _, ok := v.(*variantLadder); ok {
+			hlsNotifier.Notify(parent)
+		}
+	}
+}
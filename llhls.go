@@ -0,0 +1,81 @@
+package hls
+
+import (
+	"net/http"
+	"strconv"
+
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// llhlsPuller 拉取低延迟HLS时，下一个要下载的部分切片
+type llhlsPuller struct {
+	msn     int // 媒体序号
+	part    int // 在切片中的序号
+	started bool
+}
+
+// isLowLatency 上游支持阻塞刷新并且有部分切片
+func isLowLatency(media *m3u8.MediaPlaylist) bool {
+	return media.ServerControl != nil && media.ServerControl.CanBlockReload && media.PartTargetDuration > 0
+}
+
+// items 返回还没有下载的部分切片，已经没有部分切片的旧切片整个下载
+func (ll *llhlsPuller) items(client *http.Client, media *m3u8.MediaPlaylist) (items []*TSDownloader) {
+	liveMSN := media.MediaSequence + len(media.Segments) // 正在生成的切片
+	if !ll.started || ll.msn < media.MediaSequence || ll.msn > liveMSN {
+		// 从正在生成的切片的第一个部分开始
+		ll.msn, ll.part, ll.started = liveMSN, 0, true
+	}
+	var key *m3u8.Key
+	var initMap *m3u8.Map
+	add := func(uri string, byteRange *m3u8.ByteRange, dur float64, msn int) {
+		items = append(items, &TSDownloader{
+			client:    client,
+			uri:       uri,
+			byteRange: byteRange,
+			dur:       dur,
+			key:       key,
+			sequence:  msn,
+			initMap:   initMap,
+		})
+	}
+	addParts := func(parts []*m3u8.Part, msn int) {
+		for ; ll.part < len(parts); ll.part++ {
+			if part := parts[ll.part]; !part.Gap {
+				add(part.URI, part.ByteRange, part.Duration, msn)
+			}
+		}
+	}
+	for i, v := range media.Segments {
+		if v.Key != nil {
+			key = v.Key
+		}
+		if v.Map != nil {
+			initMap = v.Map
+		}
+		msn := media.MediaSequence + i
+		if msn < ll.msn {
+			continue
+		}
+		if len(v.Parts) > 0 {
+			addParts(v.Parts, msn)
+		} else if ll.part == 0 && !v.Gap {
+			add(v.URI, v.ByteRange, v.Duration, msn)
+		}
+		ll.msn, ll.part = msn+1, 0
+	}
+	addParts(media.Parts, liveMSN)
+	return
+}
+
+// reload 阻塞刷新请求，服务器在下一个部分切片可用时才返回播放列表
+func (ll *llhlsPuller) reload(req *http.Request) *http.Request {
+	reloadURL := *req.URL
+	query := reloadURL.Query()
+	query.Set("_HLS_msn", strconv.Itoa(ll.msn))
+	query.Set("_HLS_part", strconv.Itoa(ll.part))
+	reloadURL.RawQuery = query.Encode()
+	reloadReq := req.Clone(req.Context())
+	reloadReq.URL = &reloadURL
+	return reloadReq
+}
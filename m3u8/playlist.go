@@ -0,0 +1,488 @@
+// Package m3u8 HLS 播放列表（RFC 8216 及 LL-HLS 扩展）的数据结构、序列化和解析
+package m3u8
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc8216
+// https://datatracker.ietf.org/doc/html/draft-pantos-hls-rfc8216bis
+
+const (
+	DATE_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+
+	KEY_METHOD_NONE       = "NONE"
+	KEY_METHOD_AES_128    = "AES-128"
+	KEY_METHOD_SAMPLE_AES = "SAMPLE-AES"
+
+	MEDIA_TYPE_AUDIO           = "AUDIO"
+	MEDIA_TYPE_VIDEO           = "VIDEO"
+	MEDIA_TYPE_SUBTITLES       = "SUBTITLES"
+	MEDIA_TYPE_CLOSED_CAPTIONS = "CLOSED-CAPTIONS"
+
+	PLAYLIST_TYPE_EVENT = "EVENT"
+	PLAYLIST_TYPE_VOD   = "VOD"
+)
+
+// Playlist 媒体播放列表或主播放列表
+type Playlist interface {
+	Encode(w io.Writer) error
+	String() string
+}
+
+// ByteRange 资源中从 Offset 开始的 Length 个字节
+type ByteRange struct {
+	Length int64
+	Offset int64
+}
+
+func (b ByteRange) String() string {
+	return strconv.FormatInt(b.Length, 10) + "@" + strconv.FormatInt(b.Offset, 10)
+}
+
+// Key #EXT-X-KEY，从所在切片开始生效，直到下一个 Key
+type Key struct {
+	Method            string
+	URI               string
+	IV                []byte // 为空时使用切片的媒体序号作为IV
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+// Map #EXT-X-MAP，从所在切片开始生效的初始化片段
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+// Attribute 属性列表中的一项，Value 为原样的值，字符串包含引号
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// DateRange #EXT-X-DATERANGE，Duration 和 PlannedDuration 为0时不输出
+type DateRange struct {
+	ID               string
+	Class            string
+	StartDate        time.Time
+	Cue              string
+	EndDate          time.Time
+	Duration         float64
+	PlannedDuration  float64
+	EndOnNext        bool
+	SCTE35Cmd        []byte
+	SCTE35Out        []byte
+	SCTE35In         []byte
+	ClientAttributes []Attribute // X- 开头的自定义属性，按出现的顺序
+}
+
+// Part #EXT-X-PART，LL-HLS 的部分切片
+type Part struct {
+	URI         string
+	Duration    float64
+	Independent bool
+	ByteRange   *ByteRange
+	Gap         bool
+}
+
+// ServerControl #EXT-X-SERVER-CONTROL，为0的项不输出
+type ServerControl struct {
+	CanSkipUntil      float64
+	CanSkipDateRanges bool
+	HoldBack          float64
+	PartHoldBack      float64
+	CanBlockReload    bool
+}
+
+// PreloadHint #EXT-X-PRELOAD-HINT，ByteRangeLength 为0表示直到资源结束
+type PreloadHint struct {
+	Type            string // PART 或 MAP
+	URI             string
+	ByteRangeStart  int64
+	ByteRangeLength int64
+}
+
+// Segment 媒体切片以及写在它前面的标签
+type Segment struct {
+	URI             string
+	Duration        float64
+	Title           string
+	ByteRange       *ByteRange
+	Discontinuity   bool
+	Gap             bool
+	Key             *Key // 从该切片开始使用的密钥
+	Map             *Map // 从该切片开始使用的初始化片段
+	ProgramDateTime time.Time
+	DateRanges      []*DateRange
+	Parts           []*Part  // 组成该切片的部分切片
+	Tags            []string // 无法识别的标签，原样输出在 #EXTINF 之前
+}
+
+// MediaPlaylist 媒体播放列表
+type MediaPlaylist struct {
+	Version               int
+	TargetDuration        int
+	MediaSequence         int
+	DiscontinuitySequence int
+	PlaylistType          string
+	IndependentSegments   bool
+	IFramesOnly           bool
+	ServerControl         *ServerControl
+	PartTargetDuration    float64
+	SkippedSegments       int // #EXT-X-SKIP，增量更新时省略的切片数
+	Segments              []*Segment
+	Parts                 []*Part // 正在生成的切片中已完成的部分切片
+	PreloadHint           *PreloadHint
+	EndList               bool
+	Tags                  []string // 无法识别的播放列表标签
+	TrailingTags          []string // 最后一个切片之后无法识别的标签，例如 #EXT-X-RENDITION-REPORT，输出在部分切片之后
+}
+
+// Rendition #EXT-X-MEDIA
+type Rendition struct {
+	Type            string
+	GroupID         string
+	Name            string
+	Language        string
+	AssocLanguage   string
+	Default         bool
+	Autoselect      bool
+	Forced          bool
+	InstreamID      string
+	Characteristics string
+	Channels        string
+	URI             string
+}
+
+// Variant #EXT-X-STREAM-INF 或 #EXT-X-I-FRAME-STREAM-INF
+type Variant struct {
+	URI              string
+	Bandwidth        int
+	AverageBandwidth int
+	Codecs           string
+	Width            int
+	Height           int
+	FrameRate        float64
+	Name             string // 非标准的 NAME 属性
+	Audio            string
+	Video            string
+	Subtitles        string
+	ClosedCaptions   string // 可以是 NONE
+	IFrame           bool
+}
+
+// MasterPlaylist 主播放列表
+type MasterPlaylist struct {
+	Version             int
+	IndependentSegments bool
+	Renditions          []*Rendition
+	Variants            []*Variant
+	Tags                []string // 无法识别的标签，例如 #EXT-X-SESSION-DATA
+}
+
+// attributes 用于按顺序生成属性列表
+type attributes []string
+
+func (a *attributes) quoted(name, value string) {
+	if value != "" {
+		*a = append(*a, name+`="`+value+`"`)
+	}
+}
+
+func (a *attributes) enum(name, value string) {
+	if value != "" {
+		*a = append(*a, name+"="+value)
+	}
+}
+
+func (a *attributes) int(name string, value int64) {
+	if value != 0 {
+		*a = append(*a, name+"="+strconv.FormatInt(value, 10))
+	}
+}
+
+func (a *attributes) float(name string, value float64) {
+	if value != 0 {
+		*a = append(*a, name+"="+formatFloat(value))
+	}
+}
+
+func (a *attributes) yes(name string, value bool) {
+	if value {
+		*a = append(*a, name+"=YES")
+	}
+}
+
+func (a *attributes) hex(name string, value []byte) {
+	if len(value) > 0 {
+		*a = append(*a, name+"=0x"+strings.ToUpper(hex.EncodeToString(value)))
+	}
+}
+
+func (a attributes) String() string {
+	return strings.Join(a, ",")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (k *Key) String() string {
+	var a attributes
+	a.enum("METHOD", k.Method)
+	a.quoted("URI", k.URI)
+	a.hex("IV", k.IV)
+	a.quoted("KEYFORMAT", k.KeyFormat)
+	a.quoted("KEYFORMATVERSIONS", k.KeyFormatVersions)
+	return "#EXT-X-KEY:" + a.String()
+}
+
+func (m *Map) String() string {
+	var a attributes
+	a.quoted("URI", m.URI)
+	if m.ByteRange != nil {
+		a.quoted("BYTERANGE", m.ByteRange.String())
+	}
+	return "#EXT-X-MAP:" + a.String()
+}
+
+func (d *DateRange) String() string {
+	var a attributes
+	a.quoted("ID", d.ID)
+	a.quoted("CLASS", d.Class)
+	a.quoted("START-DATE", d.StartDate.Format(DATE_TIME_FORMAT))
+	a.quoted("CUE", d.Cue)
+	if !d.EndDate.IsZero() {
+		a.quoted("END-DATE", d.EndDate.Format(DATE_TIME_FORMAT))
+	}
+	a.float("DURATION", d.Duration)
+	a.float("PLANNED-DURATION", d.PlannedDuration)
+	for _, attr := range d.ClientAttributes {
+		a.enum(attr.Name, attr.Value)
+	}
+	a.hex("SCTE35-CMD", d.SCTE35Cmd)
+	a.hex("SCTE35-OUT", d.SCTE35Out)
+	a.hex("SCTE35-IN", d.SCTE35In)
+	a.yes("END-ON-NEXT", d.EndOnNext)
+	return "#EXT-X-DATERANGE:" + a.String()
+}
+
+func (p *Part) String() string {
+	var a attributes
+	a.enum("DURATION", formatFloat(p.Duration))
+	a.quoted("URI", p.URI)
+	a.yes("INDEPENDENT", p.Independent)
+	if p.ByteRange != nil {
+		a.quoted("BYTERANGE", p.ByteRange.String())
+	}
+	a.yes("GAP", p.Gap)
+	return "#EXT-X-PART:" + a.String()
+}
+
+func (s *ServerControl) String() string {
+	var a attributes
+	a.float("CAN-SKIP-UNTIL", s.CanSkipUntil)
+	a.yes("CAN-SKIP-DATERANGES", s.CanSkipDateRanges)
+	a.float("HOLD-BACK", s.HoldBack)
+	a.float("PART-HOLD-BACK", s.PartHoldBack)
+	a.yes("CAN-BLOCK-RELOAD", s.CanBlockReload)
+	return "#EXT-X-SERVER-CONTROL:" + a.String()
+}
+
+func (h *PreloadHint) String() string {
+	var a attributes
+	a.enum("TYPE", h.Type)
+	a.quoted("URI", h.URI)
+	a.int("BYTERANGE-START", h.ByteRangeStart)
+	a.int("BYTERANGE-LENGTH", h.ByteRangeLength)
+	return "#EXT-X-PRELOAD-HINT:" + a.String()
+}
+
+func (r *Rendition) String() string {
+	var a attributes
+	a.enum("TYPE", r.Type)
+	a.quoted("GROUP-ID", r.GroupID)
+	a.quoted("NAME", r.Name)
+	a.quoted("LANGUAGE", r.Language)
+	a.quoted("ASSOC-LANGUAGE", r.AssocLanguage)
+	a.yes("DEFAULT", r.Default)
+	a.yes("AUTOSELECT", r.Autoselect)
+	a.yes("FORCED", r.Forced)
+	a.quoted("INSTREAM-ID", r.InstreamID)
+	a.quoted("CHARACTERISTICS", r.Characteristics)
+	a.quoted("CHANNELS", r.Channels)
+	a.quoted("URI", r.URI)
+	return "#EXT-X-MEDIA:" + a.String()
+}
+
+func (v *Variant) String() string {
+	var a attributes
+	a.int("BANDWIDTH", int64(v.Bandwidth))
+	a.int("AVERAGE-BANDWIDTH", int64(v.AverageBandwidth))
+	a.quoted("CODECS", v.Codecs)
+	if v.Width > 0 && v.Height > 0 {
+		a.enum("RESOLUTION", fmt.Sprintf("%dx%d", v.Width, v.Height))
+	}
+	a.float("FRAME-RATE", v.FrameRate)
+	a.quoted("NAME", v.Name)
+	a.quoted("AUDIO", v.Audio)
+	a.quoted("VIDEO", v.Video)
+	if v.IFrame {
+		a.quoted("URI", v.URI)
+		return "#EXT-X-I-FRAME-STREAM-INF:" + a.String()
+	}
+	a.quoted("SUBTITLES", v.Subtitles)
+	if v.ClosedCaptions == "NONE" {
+		a.enum("CLOSED-CAPTIONS", v.ClosedCaptions)
+	} else {
+		a.quoted("CLOSED-CAPTIONS", v.ClosedCaptions)
+	}
+	return "#EXT-X-STREAM-INF:" + a.String() + "\n" + v.URI
+}
+
+// Encode 输出切片以及它前面的标签
+func (s *Segment) Encode(w io.Writer) (err error) {
+	var b strings.Builder
+	if s.Discontinuity {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	if s.Key != nil {
+		b.WriteString(s.Key.String() + "\n")
+	}
+	if s.Map != nil {
+		b.WriteString(s.Map.String() + "\n")
+	}
+	if !s.ProgramDateTime.IsZero() {
+		b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + s.ProgramDateTime.Format(DATE_TIME_FORMAT) + "\n")
+	}
+	for _, d := range s.DateRanges {
+		b.WriteString(d.String() + "\n")
+	}
+	for _, tag := range s.Tags {
+		b.WriteString(tag + "\n")
+	}
+	if s.Gap {
+		b.WriteString("#EXT-X-GAP\n")
+	}
+	for _, p := range s.Parts {
+		b.WriteString(p.String() + "\n")
+	}
+	fmt.Fprintf(&b, "#EXTINF:%.3f,%s\n", s.Duration, s.Title)
+	if s.ByteRange != nil {
+		b.WriteString("#EXT-X-BYTERANGE:" + s.ByteRange.String() + "\n")
+	}
+	b.WriteString(s.URI + "\n")
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+// EncodeHeader 输出第一个切片之前的播放列表标签，用于逐个追加切片的场景
+func (p *MediaPlaylist) EncodeHeader(w io.Writer) (err error) {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if p.Version > 0 {
+		fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.TargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence)
+	}
+	if p.PlaylistType != "" {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:" + p.PlaylistType + "\n")
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if p.IFramesOnly {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	if p.ServerControl != nil {
+		b.WriteString(p.ServerControl.String() + "\n")
+	}
+	if p.PartTargetDuration > 0 {
+		b.WriteString("#EXT-X-PART-INF:PART-TARGET=" + formatFloat(p.PartTargetDuration) + "\n")
+	}
+	for _, tag := range p.Tags {
+		b.WriteString(tag + "\n")
+	}
+	if p.SkippedSegments > 0 {
+		fmt.Fprintf(&b, "#EXT-X-SKIP:SKIPPED-SEGMENTS=%d\n", p.SkippedSegments)
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+func (p *MediaPlaylist) Encode(w io.Writer) (err error) {
+	if err = p.EncodeHeader(w); err != nil {
+		return
+	}
+	for _, s := range p.Segments {
+		if err = s.Encode(w); err != nil {
+			return
+		}
+	}
+	var b strings.Builder
+	for _, part := range p.Parts {
+		b.WriteString(part.String() + "\n")
+	}
+	if p.PreloadHint != nil {
+		b.WriteString(p.PreloadHint.String() + "\n")
+	}
+	for _, tag := range p.TrailingTags {
+		b.WriteString(tag + "\n")
+	}
+	if p.EndList {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+func (p *MediaPlaylist) String() string {
+	var b strings.Builder
+	p.Encode(&b)
+	return b.String()
+}
+
+// Duration 所有切片的时长之和
+func (p *MediaPlaylist) Duration() (d float64) {
+	for _, s := range p.Segments {
+		d += s.Duration
+	}
+	return
+}
+
+func (p *MasterPlaylist) Encode(w io.Writer) (err error) {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if p.Version > 0 {
+		fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	for _, tag := range p.Tags {
+		b.WriteString(tag + "\n")
+	}
+	for _, r := range p.Renditions {
+		b.WriteString(r.String() + "\n")
+	}
+	for _, v := range p.Variants {
+		b.WriteString(v.String() + "\n")
+	}
+	_, err = io.WriteString(w, b.String())
+	return
+}
+
+func (p *MasterPlaylist) String() string {
+	var b strings.Builder
+	p.Encode(&b)
+	return b.String()
+}
@@ -0,0 +1,413 @@
+package m3u8
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid m3u8: missing #EXTM3U")
+
+// Read 解析播放列表，包含 #EXT-X-STREAM-INF、#EXT-X-I-FRAME-STREAM-INF 或 #EXT-X-MEDIA 时返回 *MasterPlaylist，否则返回 *MediaPlaylist
+func Read(r io.Reader) (Playlist, error) {
+	var p parser
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for first := true; scanner.Scan(); {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			// 跳过 UTF-8 BOM
+			line = strings.TrimPrefix(line, "\ufeff")
+			if line != "#EXTM3U" {
+				return nil, ErrInvalidPlaylist
+			}
+			first = false
+			continue
+		}
+		if err := p.line(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.isMaster {
+		// 在确定是主播放列表之前出现的标签
+		p.master.Tags = append(p.segment.Tags, p.master.Tags...)
+		return &p.master, nil
+	}
+	p.media.Parts = p.segment.Parts
+	// 最后一个切片之后的 #EXT-X-DATERANGE 和无法识别的标签
+	for _, d := range p.segment.DateRanges {
+		p.media.TrailingTags = append(p.media.TrailingTags, d.String())
+	}
+	p.media.TrailingTags = append(p.media.TrailingTags, p.segment.Tags...)
+	return &p.media, nil
+}
+
+// ReadBytes 解析内存中的播放列表
+func ReadBytes(data []byte) (Playlist, error) {
+	return Read(bytes.NewReader(data))
+}
+
+// ReadFile 解析播放列表文件
+func ReadFile(name string) (Playlist, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+type parser struct {
+	media    MediaPlaylist
+	master   MasterPlaylist
+	isMaster bool
+	segment  Segment  // 正在解析的切片
+	variant  *Variant // 等待 URI 的 #EXT-X-STREAM-INF
+	rangeEnd int64    // 上一个 BYTERANGE 的结束位置，用于省略 offset 的情况
+	lastPart *Part    // 上一个部分切片，省略 offset 时从它的结束位置开始
+}
+
+func (p *parser) line(line string) (err error) {
+	if line == "" {
+		return
+	}
+	if !strings.HasPrefix(line, "#") {
+		if p.variant != nil {
+			p.variant.URI = line
+			p.master.Variants = append(p.master.Variants, p.variant)
+			p.variant = nil
+			return
+		}
+		s := p.segment
+		s.URI = line
+		if s.ByteRange == nil {
+			p.rangeEnd = 0
+		}
+		p.media.Segments = append(p.media.Segments, &s)
+		p.segment = Segment{}
+		return
+	}
+	if !strings.HasPrefix(line, "#EXT") {
+		return // 注释
+	}
+	name, value := line, ""
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		name, value = line[:i], line[i+1:]
+	}
+	switch name {
+	case "#EXT-X-VERSION":
+		p.media.Version, err = strconv.Atoi(value)
+		p.master.Version = p.media.Version
+	case "#EXT-X-INDEPENDENT-SEGMENTS":
+		p.media.IndependentSegments = true
+		p.master.IndependentSegments = true
+	case "#EXT-X-TARGETDURATION":
+		var f float64
+		f, err = strconv.ParseFloat(value, 64)
+		p.media.TargetDuration = int(math.Ceil(f))
+	case "#EXT-X-MEDIA-SEQUENCE":
+		p.media.MediaSequence, err = strconv.Atoi(value)
+	case "#EXT-X-DISCONTINUITY-SEQUENCE":
+		p.media.DiscontinuitySequence, err = strconv.Atoi(value)
+	case "#EXT-X-PLAYLIST-TYPE":
+		p.media.PlaylistType = value
+	case "#EXT-X-I-FRAMES-ONLY":
+		p.media.IFramesOnly = true
+	case "#EXT-X-ENDLIST":
+		p.media.EndList = true
+	case "#EXT-X-SERVER-CONTROL":
+		attrs := parseAttributes(value)
+		p.media.ServerControl = &ServerControl{
+			CanSkipUntil:      attrs.float("CAN-SKIP-UNTIL"),
+			CanSkipDateRanges: attrs.yes("CAN-SKIP-DATERANGES"),
+			HoldBack:          attrs.float("HOLD-BACK"),
+			PartHoldBack:      attrs.float("PART-HOLD-BACK"),
+			CanBlockReload:    attrs.yes("CAN-BLOCK-RELOAD"),
+		}
+	case "#EXT-X-PART-INF":
+		p.media.PartTargetDuration = parseAttributes(value).float("PART-TARGET")
+	case "#EXT-X-SKIP":
+		p.media.SkippedSegments = int(parseAttributes(value).int("SKIPPED-SEGMENTS"))
+	case "#EXT-X-PRELOAD-HINT":
+		attrs := parseAttributes(value)
+		p.media.PreloadHint = &PreloadHint{
+			Type:            attrs.get("TYPE"),
+			URI:             attrs.get("URI"),
+			ByteRangeStart:  attrs.int("BYTERANGE-START"),
+			ByteRangeLength: attrs.int("BYTERANGE-LENGTH"),
+		}
+	case "#EXTINF":
+		duration, title := value, ""
+		if i := strings.IndexByte(value, ','); i >= 0 {
+			duration, title = value[:i], value[i+1:]
+		}
+		p.segment.Duration, err = strconv.ParseFloat(strings.TrimSpace(duration), 64)
+		p.segment.Title = title
+	case "#EXT-X-BYTERANGE":
+		var r ByteRange
+		if r, err = p.byteRange(value); err == nil {
+			p.segment.ByteRange = &r
+			p.rangeEnd = r.Offset + r.Length
+		}
+	case "#EXT-X-DISCONTINUITY":
+		p.segment.Discontinuity = true
+	case "#EXT-X-GAP":
+		p.segment.Gap = true
+	case "#EXT-X-KEY":
+		attrs := parseAttributes(value)
+		key := &Key{
+			Method:            attrs.get("METHOD"),
+			URI:               attrs.get("URI"),
+			KeyFormat:         attrs.get("KEYFORMAT"),
+			KeyFormatVersions: attrs.get("KEYFORMATVERSIONS"),
+		}
+		if iv := attrs.get("IV"); iv != "" {
+			key.IV, err = parseHex(iv)
+		}
+		p.segment.Key = key
+	case "#EXT-X-MAP":
+		attrs := parseAttributes(value)
+		m := &Map{URI: attrs.get("URI")}
+		if br := attrs.get("BYTERANGE"); br != "" {
+			var r ByteRange
+			if r, err = parseByteRange(br, 0); err == nil {
+				m.ByteRange = &r
+			}
+		}
+		p.segment.Map = m
+	case "#EXT-X-PROGRAM-DATE-TIME":
+		p.segment.ProgramDateTime, err = parseDateTime(value)
+	case "#EXT-X-DATERANGE":
+		var d *DateRange
+		if d, err = parseDateRange(value); err == nil {
+			p.segment.DateRanges = append(p.segment.DateRanges, d)
+		}
+	case "#EXT-X-PART":
+		attrs := parseAttributes(value)
+		part := &Part{
+			URI:         attrs.get("URI"),
+			Duration:    attrs.float("DURATION"),
+			Independent: attrs.yes("INDEPENDENT"),
+			Gap:         attrs.yes("GAP"),
+		}
+		if br := attrs.get("BYTERANGE"); br != "" {
+			var offset int64
+			if last := p.lastPart; last != nil && last.URI == part.URI && last.ByteRange != nil {
+				offset = last.ByteRange.Offset + last.ByteRange.Length
+			}
+			var r ByteRange
+			if r, err = parseByteRange(br, offset); err == nil {
+				part.ByteRange = &r
+			}
+		}
+		p.lastPart = part
+		p.segment.Parts = append(p.segment.Parts, part)
+	case "#EXT-X-STREAM-INF", "#EXT-X-I-FRAME-STREAM-INF":
+		p.isMaster = true
+		attrs := parseAttributes(value)
+		v := &Variant{
+			URI:              attrs.get("URI"),
+			Bandwidth:        int(attrs.int("BANDWIDTH")),
+			AverageBandwidth: int(attrs.int("AVERAGE-BANDWIDTH")),
+			Codecs:           attrs.get("CODECS"),
+			FrameRate:        attrs.float("FRAME-RATE"),
+			Name:             attrs.get("NAME"),
+			Audio:            attrs.get("AUDIO"),
+			Video:            attrs.get("VIDEO"),
+			Subtitles:        attrs.get("SUBTITLES"),
+			ClosedCaptions:   attrs.get("CLOSED-CAPTIONS"),
+			IFrame:           name == "#EXT-X-I-FRAME-STREAM-INF",
+		}
+		if resolution := attrs.get("RESOLUTION"); resolution != "" {
+			if i := strings.IndexByte(resolution, 'x'); i > 0 {
+				v.Width, _ = strconv.Atoi(resolution[:i])
+				v.Height, _ = strconv.Atoi(resolution[i+1:])
+			}
+		}
+		if v.IFrame {
+			p.master.Variants = append(p.master.Variants, v)
+		} else {
+			p.variant = v
+		}
+	case "#EXT-X-MEDIA":
+		p.isMaster = true
+		attrs := parseAttributes(value)
+		p.master.Renditions = append(p.master.Renditions, &Rendition{
+			Type:            attrs.get("TYPE"),
+			GroupID:         attrs.get("GROUP-ID"),
+			Name:            attrs.get("NAME"),
+			Language:        attrs.get("LANGUAGE"),
+			AssocLanguage:   attrs.get("ASSOC-LANGUAGE"),
+			Default:         attrs.yes("DEFAULT"),
+			Autoselect:      attrs.yes("AUTOSELECT"),
+			Forced:          attrs.yes("FORCED"),
+			InstreamID:      attrs.get("INSTREAM-ID"),
+			Characteristics: attrs.get("CHARACTERISTICS"),
+			Channels:        attrs.get("CHANNELS"),
+			URI:             attrs.get("URI"),
+		})
+	default:
+		// 主播放列表中的标签（例如 #EXT-X-SESSION-DATA、#EXT-X-START）原样保留，媒体播放列表中的写在下一个切片之前
+		if p.isMaster {
+			p.master.Tags = append(p.master.Tags, line)
+		} else {
+			p.segment.Tags = append(p.segment.Tags, line)
+		}
+	}
+	if err != nil {
+		err = errors.New("invalid m3u8 line " + line + ": " + err.Error())
+	}
+	return
+}
+
+// byteRange 省略 offset 时紧接着上一个切片的 BYTERANGE
+func (p *parser) byteRange(value string) (ByteRange, error) {
+	return parseByteRange(value, p.rangeEnd)
+}
+
+func parseByteRange(value string, defaultOffset int64) (r ByteRange, err error) {
+	length, offset := value, ""
+	if i := strings.IndexByte(value, '@'); i >= 0 {
+		length, offset = value[:i], value[i+1:]
+	}
+	if r.Length, err = strconv.ParseInt(length, 10, 64); err != nil {
+		return
+	}
+	r.Offset = defaultOffset
+	if offset != "" {
+		r.Offset, err = strconv.ParseInt(offset, 10, 64)
+	}
+	return
+}
+
+func parseHex(value string) ([]byte, error) {
+	value = strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	if len(value)%2 == 1 {
+		value = "0" + value
+	}
+	return hex.DecodeString(value)
+}
+
+var dateTimeFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999Z0700", "2006-01-02T15:04:05.999999999"}
+
+func parseDateTime(value string) (t time.Time, err error) {
+	value = strings.Trim(value, `"`)
+	for _, format := range dateTimeFormats {
+		if t, err = time.Parse(format, value); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func parseDateRange(value string) (d *DateRange, err error) {
+	d = new(DateRange)
+	for _, attr := range parseAttributeList(value) {
+		v := unquote(attr.Value)
+		switch attr.Name {
+		case "ID":
+			d.ID = v
+		case "CLASS":
+			d.Class = v
+		case "START-DATE":
+			d.StartDate, err = parseDateTime(v)
+		case "CUE":
+			d.Cue = v
+		case "END-DATE":
+			d.EndDate, err = parseDateTime(v)
+		case "DURATION":
+			d.Duration, err = strconv.ParseFloat(v, 64)
+		case "PLANNED-DURATION":
+			d.PlannedDuration, err = strconv.ParseFloat(v, 64)
+		case "END-ON-NEXT":
+			d.EndOnNext = v == "YES"
+		case "SCTE35-CMD":
+			d.SCTE35Cmd, err = parseHex(v)
+		case "SCTE35-OUT":
+			d.SCTE35Out, err = parseHex(v)
+		case "SCTE35-IN":
+			d.SCTE35In, err = parseHex(v)
+		default:
+			d.ClientAttributes = append(d.ClientAttributes, attr)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// parseAttributeList 按顺序解析属性列表，值保持原样（字符串包含引号）
+func parseAttributeList(value string) (list []Attribute) {
+	for value != "" {
+		i := strings.IndexByte(value, '=')
+		if i < 0 {
+			return
+		}
+		attr := Attribute{Name: strings.TrimSpace(value[:i])}
+		value = value[i+1:]
+		end := 0
+		if strings.HasPrefix(value, `"`) {
+			if j := strings.IndexByte(value[1:], '"'); j >= 0 {
+				end = j + 2
+			} else {
+				end = len(value)
+			}
+		}
+		if j := strings.IndexByte(value[end:], ','); j >= 0 {
+			end += j
+		} else {
+			end = len(value)
+		}
+		attr.Value = strings.TrimSpace(value[:end])
+		list = append(list, attr)
+		value = strings.TrimPrefix(value[end:], ",")
+	}
+	return
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// attributeMap 去掉引号后的属性
+type attributeMap map[string]string
+
+func parseAttributes(value string) attributeMap {
+	attrs := make(attributeMap)
+	for _, attr := range parseAttributeList(value) {
+		attrs[attr.Name] = unquote(attr.Value)
+	}
+	return attrs
+}
+
+func (a attributeMap) get(name string) string {
+	return a[name]
+}
+
+func (a attributeMap) int(name string) int64 {
+	v, _ := strconv.ParseInt(a[name], 10, 64)
+	return v
+}
+
+func (a attributeMap) float(name string) float64 {
+	v, _ := strconv.ParseFloat(a[name], 64)
+	return v
+}
+
+func (a attributeMap) yes(name string) bool {
+	return a[name] == "YES"
+}
@@ -0,0 +1,178 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+)
+
+// roundTrip 解析后输出两次，第二次的结果必须与第一次相同
+func roundTrip(t *testing.T, input string) (Playlist, string) {
+	t.Helper()
+	playlist, err := ReadBytes([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := playlist.String()
+	again, err := ReadBytes([]byte(first))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, first)
+	}
+	if second := again.String(); second != first {
+		t.Fatalf("round trip is not stable\nfirst:\n%s\nsecond:\n%s", first, second)
+	}
+	return playlist, first
+}
+
+// inOrder 每一项都出现在前一项之后
+func inOrder(t *testing.T, text string, lines ...string) {
+	t.Helper()
+	pos := 0
+	for _, line := range lines {
+		i := strings.Index(text[pos:], line)
+		if i < 0 {
+			t.Fatalf("%q missing or out of order in\n%s", line, text)
+		}
+		pos += i + len(line)
+	}
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	playlist, text := roundTrip(t, `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:100
+#EXT-X-DISCONTINUITY-SEQUENCE:2
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x000102030405060708090a0b0c0d0e0f
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00.000Z
+#EXT-X-CUE-OUT:30
+#EXTINF:6.000,
+seg100.ts
+# comment
+#EXT-X-DISCONTINUITY
+#EXTINF:5.500,title
+seg101.ts
+#EXT-X-DATERANGE:ID="ad1",START-DATE="2024-01-01T00:00:12.000Z",PLANNED-DURATION=30
+#EXT-X-CUSTOM:1
+`)
+	media, ok := playlist.(*MediaPlaylist)
+	if !ok {
+		t.Fatalf("got %T", playlist)
+	}
+	if media.MediaSequence != 100 || media.DiscontinuitySequence != 2 || len(media.Segments) != 2 {
+		t.Fatalf("unexpected header %+v", media)
+	}
+	first, second := media.Segments[0], media.Segments[1]
+	if first.Key == nil || len(first.Key.IV) != 16 || first.ProgramDateTime.IsZero() || len(first.Tags) != 1 {
+		t.Fatalf("unexpected first segment %+v", first)
+	}
+	if !second.Discontinuity || second.Duration != 5.5 || second.Title != "title" {
+		t.Fatalf("unexpected second segment %+v", second)
+	}
+	if len(media.TrailingTags) != 2 {
+		t.Fatalf("trailing tags %q", media.TrailingTags)
+	}
+	inOrder(t, text, "#EXT-X-CUE-OUT:30", "seg100.ts", "seg101.ts", "#EXT-X-CUSTOM:1")
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	playlist, text := roundTrip(t, `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-10
+#EXT-X-DEFINE:NAME="host",VALUE="example.com"
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Example"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,AVERAGE-BANDWIDTH=1800000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="aac",CLOSED-CAPTIONS="cc"
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CLOSED-CAPTIONS=NONE
+360p.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200000,URI="720p_iframes.m3u8"
+`)
+	master, ok := playlist.(*MasterPlaylist)
+	if !ok {
+		t.Fatalf("got %T", playlist)
+	}
+	if len(master.Renditions) != 2 || len(master.Variants) != 3 {
+		t.Fatalf("renditions %d variants %d", len(master.Renditions), len(master.Variants))
+	}
+	v := master.Variants[0]
+	if v.URI != "720p.m3u8" || v.Width != 1280 || v.Height != 720 || v.Codecs != "avc1.64001f,mp4a.40.2" || v.Audio != "aac" {
+		t.Fatalf("unexpected variant %+v", v)
+	}
+	if !master.Variants[2].IFrame || master.Variants[2].URI != "720p_iframes.m3u8" {
+		t.Fatalf("unexpected i-frame variant %+v", master.Variants[2])
+	}
+	inOrder(t, text, "#EXT-X-START:TIME-OFFSET=-10", `#EXT-X-DEFINE:NAME="host",VALUE="example.com"`, `#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Example"`)
+}
+
+func TestLowLatencyPlaylist(t *testing.T) {
+	playlist, text := roundTrip(t, `#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-TARGETDURATION:4
+#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3,CAN-SKIP-UNTIL=24
+#EXT-X-PART-INF:PART-TARGET=1
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-PART:DURATION=2,URI="seg10.0.m4s",INDEPENDENT=YES
+#EXT-X-PART:DURATION=2,URI="seg10.1.m4s"
+#EXTINF:4.000,
+seg10.m4s
+#EXT-X-PART:DURATION=1,URI="seg11.m4s",BYTERANGE="1000@0",INDEPENDENT=YES
+#EXT-X-PART:DURATION=1,URI="seg11.m4s",BYTERANGE="1200"
+#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg11.m4s",BYTERANGE-START=2200
+#EXT-X-RENDITION-REPORT:URI="../audio/a.m3u8",LAST-MSN=10,LAST-PART=1
+`)
+	media := playlist.(*MediaPlaylist)
+	if media.ServerControl == nil || !media.ServerControl.CanBlockReload || media.ServerControl.PartHoldBack != 3 || media.PartTargetDuration != 1 {
+		t.Fatalf("unexpected server control %+v part target %v", media.ServerControl, media.PartTargetDuration)
+	}
+	if len(media.Segments) != 1 || len(media.Segments[0].Parts) != 2 || media.Segments[0].Map == nil {
+		t.Fatalf("unexpected segments %+v", media.Segments)
+	}
+	if len(media.Parts) != 2 || media.Parts[1].ByteRange == nil || *media.Parts[1].ByteRange != (ByteRange{Length: 1200, Offset: 1000}) {
+		t.Fatalf("unexpected parts %+v", media.Parts)
+	}
+	if media.PreloadHint == nil || media.PreloadHint.ByteRangeStart != 2200 {
+		t.Fatalf("unexpected preload hint %+v", media.PreloadHint)
+	}
+	inOrder(t, text, "seg10.m4s", `#EXT-X-PART:DURATION=1,URI="seg11.m4s",BYTERANGE="1200@1000"`, "#EXT-X-PRELOAD-HINT", "#EXT-X-RENDITION-REPORT")
+	if strings.Index(text, "#EXT-X-RENDITION-REPORT") < strings.Index(text, "#EXTINF") {
+		t.Fatalf("rendition report moved into the header\n%s", text)
+	}
+}
+
+func TestByteRangePlaylist(t *testing.T) {
+	playlist, text := roundTrip(t, `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:4
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:4.000,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXTINF:4.000,
+#EXT-X-BYTERANGE:1200
+main.mp4
+#EXTINF:2.000,
+other.ts
+#EXT-X-ENDLIST
+`)
+	media := playlist.(*MediaPlaylist)
+	if !media.EndList || media.PlaylistType != PLAYLIST_TYPE_VOD || len(media.Segments) != 3 {
+		t.Fatalf("unexpected playlist %+v", media)
+	}
+	if m := media.Segments[0].Map; m == nil || m.ByteRange == nil || *m.ByteRange != (ByteRange{Length: 720}) {
+		t.Fatalf("unexpected map %+v", media.Segments[0].Map)
+	}
+	if r := media.Segments[1].ByteRange; r == nil || *r != (ByteRange{Length: 1200, Offset: 1720}) {
+		t.Fatalf("unexpected byte range %+v", r)
+	}
+	if media.Segments[2].ByteRange != nil {
+		t.Fatalf("unexpected byte range %+v", media.Segments[2].ByteRange)
+	}
+	if media.Duration() != 10 {
+		t.Fatalf("duration %v", media.Duration())
+	}
+	inOrder(t, text, "#EXT-X-BYTERANGE:1000@720", "#EXT-X-BYTERANGE:1200@1720", "other.ts", "#EXT-X-ENDLIST")
+}
@@ -4,10 +4,10 @@ import (
 	"embed"
 	"fmt"
 	"log"
-	"math"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,9 +27,10 @@ var defaultTS []byte
 
 //go:embed default.yaml
 var defaultYaml DefaultYaml
-var defaultSeq = 0                        // 默认片头的全局序号
 var writing = make(map[string]*HLSWriter) // preload 使用
 var writingMap sync.Map                   // 非preload使用
+
+const recordPrefix = "record/" // 录制文件的访问路径前缀
 var hlsConfig = &HLSConfig{}
 var HLSPlugin = InstallPlugin(hlsConfig, defaultYaml)
 
@@ -38,14 +39,25 @@ type HLSConfig struct {
 	config.Publish
 	config.Pull
 	config.Subscribe
-	Fragment          time.Duration `default:"2s" desc:"ts分片大小"`
-	Window            int           `default:"3" desc:"m3u8窗口大小(包含ts的数量)"`
-	Filter            config.Regexp `desc:"用于过滤的正则表达式"` // 过滤，正则表达式
-	Path              string        `desc:"保存 ts 文件的路径"`
-	DefaultTS         string        `desc:"默认的ts文件"`                                     // 默认的ts文件
-	DefaultTSDuration time.Duration `desc:"默认的ts文件时长"`                                   // 默认的ts文件时长
-	RelayMode         int           `desc:"转发模式（转协议会消耗资源）" enum:"0:只转协议,1:纯转发,2:转协议+转发"` // 转发模式,0:转协议+不转发,1:不转协议+转发，2:转协议+转发
-	Preload           bool          `desc:"是否预加载，提高响应速度"`                                // 是否预加载，提高响应速度
+	Fragment          time.Duration     `default:"2s" desc:"ts分片大小"`
+	Window            int               `default:"3" desc:"m3u8窗口大小(包含ts的数量)"`
+	Filter            config.Regexp     `desc:"用于过滤的正则表达式"` // 过滤，正则表达式
+	Path              string            `desc:"保存 ts 文件的路径"`
+	DefaultTS         string            `desc:"默认的ts文件"`                                     // 默认的ts文件
+	DefaultTSDuration time.Duration     `desc:"默认的ts文件时长"`                                   // 默认的ts文件时长
+	Slates            map[string]string `desc:"按流路径正则匹配的默认ts文件，匹配不到时使用 defaultts"`           // 不同的流可以播放不同的片头
+	StitchPath        string            `desc:"服务端插播素材的根目录"`                                 // 每个子目录包含一个m3u8和对应的ts
+	SingleFile        bool              `desc:"保存时把所有ts追加到同一个文件中，用 BYTERANGE 描述切片"`          // 避免录制产生大量小文件
+	RelayMode         int               `desc:"转发模式（转协议会消耗资源）" enum:"0:只转协议,1:纯转发,2:转协议+转发"` // 转发模式,0:转协议+不转发,1:不转协议+转发，2:转协议+转发
+	Preload           bool              `desc:"是否预加载，提高响应速度"`                                // 是否预加载，提高响应速度
+	Progressive       bool              `desc:"是否在m3u8中提前告知正在写入的切片，以便边写边读"`                  // 低延迟，需要播放器和CDN支持 chunked
+	Subtitle          string            `desc:"WebVTT字幕的语言（如 zh），为空则不输出字幕"`                  // 字幕通过 api/subtitle 推送
+	Variant           string            `desc:"拉取主播放列表时选择变体的策略"`                             // highest、lowest、bandwidth:码率、resolution:宽x高、name:名称、codec:编码
+	VodLoop           bool              `desc:"拉取点播m3u8时循环播放"`                               // 用点播内容做24小时频道
+	Language          string            `desc:"拉取时优先选择的音轨和字幕语言"`                             // 逗号分隔，如 zh,en，没有匹配时选择 DEFAULT
+	MultiAudio        bool              `desc:"拉取时把其他音轨也作为单独的轨道"`                            // 轨道名称如 aac_en
+	Backups           map[string]string `desc:"按流路径配置拉流的备用地址，多个用空格分隔"`                       // 上游出错、停止更新或超时时按顺序切换
+	Retry             RetryPolicy       `desc:"拉流出错时的重试策略"`                                  // 重试期间保持流不被关闭
 }
 
 func (c *HLSConfig) OnEvent(event any) {
@@ -55,7 +67,7 @@ func (c *HLSConfig) OnEvent(event any) {
 			c.Internal = false // 如何不预加载，则为非内部订阅
 		}
 		for streamPath, url := range c.PullOnStart {
-			if err := HLSPlugin.Pull(streamPath, url, new(HLSPuller), 0); err != nil {
+			if err := pullStream(streamPath, url, new(HLSPuller), 0); err != nil {
 				HLSPlugin.Error("pull", zap.String("streamPath", streamPath), zap.String("url", url), zap.Error(err))
 			}
 		}
@@ -66,18 +78,19 @@ func (c *HLSConfig) OnEvent(event any) {
 			} else {
 				log.Panic("read default ts error")
 			}
+			if c.DefaultTSDuration == 0 {
+				c.DefaultTSDuration = tsDuration(defaultTS)
+			}
 		} else {
 			c.DefaultTSDuration = time.Second * 388 / 100
 		}
 		if c.DefaultTSDuration == 0 {
 			log.Panic("default ts duration error")
-		} else {
-			go func() {
-				ticker := time.NewTicker(c.DefaultTSDuration)
-				for range ticker.C {
-					defaultSeq++
-				}
-			}()
+		}
+		defaultSlate.Data = defaultTS
+		defaultSlate.Duration = c.DefaultTSDuration
+		if err := c.loadSlates(); err != nil {
+			log.Panic("load slates error: ", err)
 		}
 	case SEclose:
 		if c.Preload {
@@ -97,7 +110,7 @@ func (c *HLSConfig) OnEvent(event any) {
 		}
 	case InvitePublish: //按需拉流
 		if remoteURL := c.CheckPullOnSub(v.Target); remoteURL != "" {
-			if err := HLSPlugin.Pull(v.Target, remoteURL, new(HLSPuller), 0); err != nil {
+			if err := invitePull(v.Target, remoteURL, new(HLSPuller)); err != nil {
 				HLSPlugin.Error("pull", zap.String("streamPath", v.Target), zap.String("url", remoteURL), zap.Error(err))
 			}
 		}
@@ -123,7 +136,20 @@ func (config *HLSConfig) API_Pull(w http.ResponseWriter, r *http.Request) {
 	targetURL := r.URL.Query().Get("target")
 	streamPath := r.URL.Query().Get("streamPath")
 	save, _ := strconv.Atoi(r.URL.Query().Get("save"))
-	if err := HLSPlugin.Pull(streamPath, targetURL, new(HLSPuller), save); err != nil {
+	retry, err := parseRetryPolicy(r.URL.Query())
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	puller := &HLSPuller{
+		Loop:       r.URL.Query().Get("loop") == "1",
+		Variant:    r.URL.Query().Get("variant"),
+		Language:   r.URL.Query().Get("language"),
+		MultiAudio: r.URL.Query().Get("multiaudio") == "1",
+		Backups:    r.URL.Query()["backup"],
+		Retry:      retry,
+	}
+	if err = pullStream(streamPath, targetURL, puller, save); err != nil {
 		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
 	} else {
 		util.ReturnOK(w, r)
@@ -139,97 +165,145 @@ func (config *HLSConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if !config.Preload {
 		waitTimeout = time.Second * 10
 	}
-	waitStart := time.Now()
+	if config.serveRecord(w, r, fileName) {
+		return
+	}
+	var deadline <-chan time.Time
+	if waitTimeout > 0 {
+		timer := time.NewTimer(waitTimeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	// 等待期间写入者结束则说明流已不可用
+	writerGone := func(key string) bool {
+		return memoryTs.Get(key) == nil && memoryTs.Get(path.Dir(key)) == nil
+	}
 	if strings.HasSuffix(r.URL.Path, ".m3u8") {
 		w.Header().Add("Content-Type", "application/vnd.apple.mpegurl")
-		for {
-			if v, ok := memoryM3u8.Load(strings.TrimSuffix(fileName, ".m3u8")); ok {
+		m3u8Name := strings.TrimSuffix(fileName, ".m3u8")
+		changed, cancel := hlsNotifier.Wait(m3u8Name)
+		defer func() { cancel() }()
+		for invited := false; ; {
+			if v, ok := memoryM3u8.Load(m3u8Name); ok {
 				switch hls := v.(type) {
 				case *TrackReader:
 					hls.RLock()
 					w.Write(hls.M3u8)
+					if hls.prefetch != "" {
+						// #EXT-X-PREFETCH 不是标准标签，来自 LHLS 方案，只有 hls.js 等部分播放器支持，其他播放器会忽略
+						fmt.Fprintf(w, "#EXT-X-PREFETCH:%s\n", hls.prefetch)
+					}
 					hls.RUnlock()
 					return
+				case *SubtitleReader:
+					hls.RLock()
+					w.Write(hls.M3u8)
+					hls.RUnlock()
+					return
+				case IFramePlaylist:
+					hls.RLock()
+					w.Write(hls.IFrameM3u8)
+					hls.RUnlock()
+					return
+				case *variantLadder:
+					// 等待所有变体就绪，超时后只返回已经就绪的变体
+					hls.invite(r.URL.RawQuery)
+					invited = true
+					if master, ok := hls.master(deadline == nil); ok {
+						fmt.Fprint(w, strings.Replace(master, "?sub=1", util.Conditoinal(waitTimeout > 0, fmt.Sprintf("?sub=1&timeout=%s", waitTimeout), ""), -1))
+						return
+					}
 				case string:
 					fmt.Fprint(w, strings.Replace(hls, "?sub=1", util.Conditoinal(waitTimeout > 0, fmt.Sprintf("?sub=1&timeout=%s", waitTimeout), ""), -1))
 					return
-					// 				if _, ok := memoryM3u8.Load(hls); ok {
-					// 					ss := strings.Split(hls, "/")
-					// 					m3u8 := fmt.Sprintf(`#EXTM3U
-					// #EXT-X-VERSION:3
-					// #EXT-X-STREAM-INF:BANDWIDTH=2560000
-					// %s/%s.m3u8
-					// 					`, ss[len(ss)-2], ss[len(ss)-1])
-					// 					w.Write([]byte(m3u8))
-					// 					return
-					// 				}
 				}
 			}
-			if waitTimeout > 0 && time.Since(waitStart) < waitTimeout {
-				if query.Get("sub") == "" {
-					streamPath := strings.TrimSuffix(fileName, ".m3u8")
-					if !config.Preload {
-						writer, loaded := writingMap.LoadOrStore(streamPath, new(HLSWriter))
-						if !loaded {
-							outStream := writer.(*HLSWriter)
-							go outStream.Start(streamPath + "?" + r.URL.RawQuery)
-						}
-					} else {
-						TryInvitePublish(streamPath)
+			if deadline == nil {
+				break
+			}
+			if !invited && query.Get("sub") == "" {
+				invited = true
+				if !config.Preload {
+					writer, loaded := writingMap.LoadOrStore(m3u8Name, new(HLSWriter))
+					if !loaded {
+						outStream := writer.(*HLSWriter)
+						go outStream.Start(m3u8Name + "?" + r.URL.RawQuery)
 					}
+				} else {
+					TryInvitePublish(m3u8Name)
+				}
+			}
+			select {
+			case <-changed:
+				if _, ok := memoryM3u8.Load(m3u8Name); !ok && writerGone(m3u8Name) {
+					http.Error(w, "stream unavailable", http.StatusServiceUnavailable)
+					return
 				}
-				time.Sleep(time.Second)
+				cancel()
+				changed, cancel = hlsNotifier.Wait(m3u8Name)
 				continue
-			} else {
-				break
+			case <-deadline:
+				// 再检查一次，变体列表可以只返回已经就绪的部分
+				deadline = nil
+				continue
+			case <-r.Context().Done():
+				return
 			}
 		}
-
-		w.Write([]byte(fmt.Sprintf(`#EXTM3U
-#EXT-X-VERSION:3
-#EXT-X-MEDIA-SEQUENCE:%d
-#EXT-X-TARGETDURATION:%d
-#EXT-X-DISCONTINUITY-SEQUENCE:%d
-#EXT-X-DISCONTINUITY
-#EXTINF:%.3f,
-default.ts`, defaultSeq, int(math.Ceil(config.DefaultTSDuration.Seconds())), defaultSeq, config.DefaultTSDuration.Seconds())))
-	} else if strings.HasSuffix(r.URL.Path, ".ts") {
-		w.Header().Add("Content-Type", "video/mp2t") //video/mp2t
+		if streamKnown(m3u8Name) {
+			writeSlatePlaylist(w, m3u8Name)
+		} else {
+			http.NotFound(w, r)
+		}
+	} else if strings.HasSuffix(r.URL.Path, ".ts") || strings.HasSuffix(r.URL.Path, ".vtt") {
+		w.Header().Add("Content-Type", util.Conditoinal(strings.HasSuffix(r.URL.Path, ".vtt"), "text/vtt", "video/mp2t")) //video/mp2t
 		streamPath := path.Dir(fileName)
-		for {
+		changed, cancel := hlsNotifier.Wait(streamPath)
+		defer func() { cancel() }()
+		for found := false; ; {
 			tsData := memoryTs.Get(streamPath)
 			if tsData == nil {
 				tsData = memoryTs.Get(path.Dir(streamPath))
-				if tsData == nil {
-					if waitTimeout > 0 && time.Since(waitStart) < waitTimeout {
-						time.Sleep(time.Second)
-						continue
-					} else {
-						w.Write(defaultTS)
-						return
-					}
-				}
 			}
-			for {
+			if tsData != nil {
+				found = true
 				if tsData := tsData.GetTs(fileName); tsData != nil {
 					switch v := tsData.(type) {
+					case *MemorySegment:
+						v.ServeHTTP(w, r)
+					case StaticTs:
+						w.Write(v)
 					case *MemoryTs:
 						v.WriteTo(w)
 					case *util.ListItem[util.Buffer]:
 						w.Write(v.Value)
 					}
 					return
-				} else {
-					if waitTimeout > 0 && time.Since(waitStart) < waitTimeout {
-						time.Sleep(time.Second)
-						continue
-					} else {
-						w.Write(defaultTS)
-						return
-					}
 				}
+			} else if found {
+				http.Error(w, "stream unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			// 流中没有该切片时才返回默认切片
+			if slate := getSlate(fileName); slate != nil {
+				w.Write(slate.Data)
+				return
 			}
+			if deadline == nil {
+				break
+			}
+			select {
+			case <-changed:
+				cancel()
+				changed, cancel = hlsNotifier.Wait(streamPath)
+				continue
+			case <-deadline:
+			case <-r.Context().Done():
+				return
+			}
+			break
 		}
+		http.NotFound(w, r)
 	} else {
 		f, err := hls_js.ReadFile("hls.js/" + fileName)
 		if err != nil {
@@ -247,3 +321,44 @@ default.ts`, defaultSeq, int(math.Ceil(config.DefaultTSDuration.Seconds())), def
 		// }
 	}
 }
+
+// streamKnown 流正在发布或者之前输出过直播，等待超时后才返回默认切片，否则返回404
+func streamKnown(name string) bool {
+	if Streams.Get(name) != nil || Streams.Get(path.Dir(name)) != nil {
+		return true
+	}
+	_, ok := timelines.Load(name)
+	return ok
+}
+
+// serveRecord 开启 singlefile 时从保存目录中读取 record/ 下的录制m3u8和ts，支持 Range 请求
+func (config *HLSConfig) serveRecord(w http.ResponseWriter, r *http.Request, fileName string) bool {
+	if config.Path == "" || !config.SingleFile || !strings.HasPrefix(fileName, recordPrefix) {
+		return false
+	}
+	fileName = strings.TrimPrefix(fileName, recordPrefix)
+	var contentType string
+	switch path.Ext(fileName) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".ts":
+		contentType = "video/mp2t"
+	default:
+		http.NotFound(w, r)
+		return true
+	}
+	f, err := os.Open(filepath.Join(config.Path, filepath.FromSlash(path.Clean("/"+fileName))))
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return true
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, fileName, info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,167 @@
+package hls
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/util"
+)
+
+// https://developer.apple.com/library/archive/documentation/AudioVideo/Conceptual/HTTP_Live_Streaming_Metadata_Spec/
+
+const (
+	PID_ID3            = 0x102
+	STREAM_TYPE_ID3    = 0x15 // Metadata carried in PES packets
+	STREAM_ID_PRIVATE1 = 0xbd
+	maxID3Size         = 0xffff - 8
+)
+
+var ErrNoHLSWriter = errors.New("hls writer not found")
+var ErrID3TooLarge = errors.New("id3 tag too large")
+
+// InsertMetadata 向正在写入的HLS流插入一个ID3标签，时间戳为当前写入的帧的PTS，供其他插件调用
+func InsertMetadata(streamPath string, tag []byte) error {
+	if hls, ok := memoryTs.Get(streamPath).(*HLSWriter); ok {
+		return hls.InsertID3(tag)
+	}
+	return ErrNoHLSWriter
+}
+
+// ID3TXXX 生成只包含一个 TXXX 帧的 ID3v2.4 标签
+func ID3TXXX(description, value string) []byte {
+	frameSize := 1 + len(description) + 1 + len(value)
+	tag := make([]byte, 0, 10+10+frameSize)
+	tag = append(tag, 'I', 'D', '3', 4, 0, 0)
+	tag = appendSyncSafe(tag, 10+frameSize)
+	tag = append(tag, 'T', 'X', 'X', 'X')
+	tag = appendSyncSafe(tag, frameSize)
+	tag = append(tag, 0, 0, 3) // flags, UTF-8
+	tag = append(tag, description...)
+	tag = append(tag, 0)
+	return append(tag, value...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendSyncSafe(b []byte, size int) []byte {
+	return append(b, byte(size>>21)&0x7f, byte(size>>14)&0x7f, byte(size>>7)&0x7f, byte(size)&0x7f)
+}
+
+// InsertID3 有视频时写入所有视频轨道，否则写入音频轨道
+func (hls *HLSWriter) InsertID3(tag []byte) (err error) {
+	if len(tag) > maxID3Size {
+		return ErrID3TooLarge
+	}
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	for _, t := range hls.video_tracks {
+		if !t.id3 {
+			t.ts.PMT = id3PMT(videoStreamType(t.CodecID), mpegts.PID_VIDEO)
+		}
+		t.writeID3(tag)
+	}
+	if len(hls.video_tracks) == 0 {
+		for _, t := range hls.audio_tracks {
+			if !t.id3 {
+				t.ts.PMT = id3PMT(mpegts.STREAM_TYPE_AAC, mpegts.PID_AUDIO)
+			}
+			t.writeID3(tag)
+		}
+	}
+	return
+}
+
+func videoStreamType(codecID codec.VideoCodecID) byte {
+	if codecID == codec.CodecID_H265 {
+		return mpegts.STREAM_TYPE_H265
+	}
+	return mpegts.STREAM_TYPE_H264
+}
+
+// writeID3 把ID3标签封装成PES写入当前切片，调用者需持有 muxLock
+func (t *TrackReader) writeID3(tag []byte) {
+	t.id3 = true
+	pes := make([]byte, 0, 14+len(tag))
+	pes = append(pes, 0, 0, 1, STREAM_ID_PRIVATE1)
+	pes = appendUint16(pes, uint16(3+5+len(tag)))
+	pes = append(pes, 0x84, 0x80, 5) // data_alignment_indicator, PTS only
+	pts := uint64(t.pts)
+	pes = append(pes,
+		0x21|byte(pts>>29)&0x0e,
+		byte(pts>>22),
+		byte(pts>>14)&0xfe|1,
+		byte(pts>>7),
+		byte(pts<<1)&0xfe|1)
+	pes = append(pes, tag...)
+	for first := true; len(pes) > 0; first = false {
+		item := t.ts.BytesPool.Get(mpegts.TS_PACKET_SIZE)
+		packet := item.Value
+		packet[0] = 0x47
+		packet[1] = byte(PID_ID3>>8) & 0x1f
+		if first {
+			packet[1] |= 0x40
+		}
+		packet[2] = byte(PID_ID3 & 0xff)
+		if stuffing := mpegts.TS_PACKET_SIZE - 4 - len(pes); stuffing > 0 {
+			packet[3] = 0x30 | t.id3cc
+			packet[4] = byte(stuffing - 1)
+			if stuffing > 1 {
+				packet[5] = 0
+				for i := 6; i < 4+stuffing; i++ {
+					packet[i] = 0xff
+				}
+			}
+			copy(packet[4+stuffing:], pes)
+			pes = nil
+		} else {
+			packet[3] = 0x10 | t.id3cc
+			pes = pes[copy(packet[4:], pes):]
+		}
+		t.id3cc = (t.id3cc + 1) & 0x0f
+		t.ts.Push(item)
+	}
+	t.ts.written()
+}
+
+// id3PMT 生成包含一路音视频和ID3元数据流的PMT
+func id3PMT(streamType byte, pid uint16) util.Buffer {
+	id3Identifier := []byte{0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0}
+	pmt := pmtTable{
+		pcrPID: pid,
+		// metadata_pointer_descriptor
+		info: append(append([]byte{0x25, 15}, id3Identifier...), 0x1f, 0x00, 0x01),
+		streams: []pmtStream{
+			{pid: pid, streamType: streamType},
+			// metadata_descriptor
+			{pid: PID_ID3, streamType: STREAM_TYPE_ID3, info: append(append([]byte{0x26, 13}, id3Identifier...), 0x0f)},
+		},
+	}
+	return psiPacket(mpegts.PID_PMT, pmt.section())
+}
+
+// API_Metadata 请求体为元数据，默认封装为 TXXX 帧（description 由 desc 参数指定），raw=1 时请求体为完整的ID3标签
+func (config *HLSConfig) API_Metadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	streamPath := query.Get("streamPath")
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		util.ReturnError(util.APIErrorQueryParse, "metadata body required", w, r)
+		return
+	}
+	tag := body
+	if query.Get("raw") == "" {
+		tag = ID3TXXX(query.Get("desc"), string(body))
+	}
+	if err = InsertMetadata(streamPath, tag); err == ErrNoHLSWriter {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
@@ -0,0 +1,139 @@
+package hls
+
+import (
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+// PAT和PMT的解析与生成，ID3元数据、fMP4转封装、音轨合并、插播素材和 SAMPLE-AES 解密共用
+// 只处理单个ts包内的 section，生成的PAT只有节目1
+
+// pmtStream PMT中的一个基本流
+type pmtStream struct {
+	pid        uint16
+	streamType byte
+	info       []byte // ES_info 中的描述符
+}
+
+// pmtTable 解析后的PMT
+type pmtTable struct {
+	program uint16 // program_number，为0时使用1
+	pcrPID  uint16
+	info    []byte // program_info 中的描述符
+	streams []pmtStream
+}
+
+// psiSection 返回负载中从 table_id 开始、不含CRC的 section，payload 为带 pointer_field 的ts包负载，section 跨包时返回 nil
+func psiSection(payload []byte) []byte {
+	if len(payload) == 0 || int(payload[0])+1 >= len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2]))
+	if end < 12 || end > len(section) {
+		return nil
+	}
+	return section[:end-4]
+}
+
+// parsePAT 返回PAT中第一个节目的PMT的PID，没有时返回 -1
+func parsePAT(section []byte) int {
+	if len(section) < 8 || section[0] != 0 {
+		return -1
+	}
+	for i := 8; i+4 <= len(section); i += 4 {
+		if section[i] != 0 || section[i+1] != 0 {
+			return int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		}
+	}
+	return -1
+}
+
+// parsePMT 解析不含CRC的PMT section，描述符会被复制
+func parsePMT(section []byte) (pmt pmtTable, ok bool) {
+	if len(section) < 12 || section[0] != 2 {
+		return
+	}
+	infoEnd := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	if infoEnd > len(section) {
+		return
+	}
+	pmt.program = uint16(section[3])<<8 | uint16(section[4])
+	pmt.pcrPID = uint16(section[8]&0x1f)<<8 | uint16(section[9])
+	pmt.info = append([]byte(nil), section[12:infoEnd]...)
+	for i := infoEnd; i+5 <= len(section); {
+		end := i + 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+		if end > len(section) {
+			return
+		}
+		pmt.streams = append(pmt.streams, pmtStream{
+			pid:        uint16(section[i+1]&0x1f)<<8 | uint16(section[i+2]),
+			streamType: section[i],
+			info:       append([]byte(nil), section[i+5:end]...),
+		})
+		i = end
+	}
+	return pmt, true
+}
+
+// patSection 生成只有一个节目的PAT section，不含CRC
+func patSection(pmtPID uint16) []byte {
+	pat := []byte{0x00, 0, 0, 0x00, 0x01, 0xc1, 0, 0, 0x00, 0x01}
+	return appendUint16(pat, 0xe000|pmtPID)
+}
+
+// section 生成PMT section，不含CRC
+func (pmt *pmtTable) section() []byte {
+	program := pmt.program
+	if program == 0 {
+		program = 1
+	}
+	section := appendUint16([]byte{0x02, 0, 0}, program)
+	section = append(section, 0xc1, 0, 0)
+	section = appendUint16(section, 0xe000|pmt.pcrPID)
+	section = appendUint16(section, 0xf000|uint16(len(pmt.info)))
+	section = append(section, pmt.info...)
+	for _, s := range pmt.streams {
+		section = append(section, s.streamType)
+		section = appendUint16(section, 0xe000|s.pid)
+		section = appendUint16(section, 0xf000|uint16(len(s.info)))
+		section = append(section, s.info...)
+	}
+	return section
+}
+
+// psiPacket 计算 section_length 和CRC后封装成一个ts包，continuity_counter 为0
+func psiPacket(pid uint16, section []byte) []byte {
+	sectionLength := len(section) - 3 + 4
+	section[1] = 0xb0 | byte(sectionLength>>8)&0x0f
+	section[2] = byte(sectionLength)
+	crc := crc32MPEG2(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	packet := make([]byte, mpegts.TS_PACKET_SIZE)
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8)&0x1f
+	packet[2] = byte(pid)
+	packet[3] = 0x10
+	n := 5 + copy(packet[5:], section)
+	for i := n; i < len(packet); i++ {
+		packet[i] = 0xff
+	}
+	return packet
+}
+
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
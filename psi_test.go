@@ -0,0 +1,41 @@
+package hls
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPSIRoundTrip(t *testing.T) {
+	pat := psiPacket(0, patSection(0x1000))
+	section := psiSection(pat[4:])
+	if section == nil || parsePAT(section) != 0x1000 {
+		t.Fatalf("PAT %x", pat[:20])
+	}
+	want := pmtTable{
+		program: 1,
+		pcrPID:  0x100,
+		info:    []byte{0x05, 4, 'C', 'U', 'E', 'I'},
+		streams: []pmtStream{
+			{pid: 0x100, streamType: 0x1b},
+			{pid: 0x101, streamType: 0x0f, info: []byte{0x0a, 4, 'e', 'n', 'g', 0}},
+		},
+	}
+	packet := psiPacket(0x1000, want.section())
+	if pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2]); pid != 0x1000 || packet[1]&0x40 == 0 {
+		t.Errorf("packet header %x", packet[:4])
+	}
+	section = psiSection(packet[4:])
+	// 带上CRC重新计算的结果为0
+	if crc := crc32MPEG2(packet[5 : 5+len(section)+4]); crc != 0 {
+		t.Errorf("CRC mismatch: %#x", crc)
+	}
+	got, ok := parsePMT(section)
+	if !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// 描述符长度超出 section 时解析失败
+	section[len(section)-1-6] = 0xff
+	if _, ok = parsePMT(section); ok {
+		t.Error("truncated PMT parsed")
+	}
+}
@@ -5,18 +5,19 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/quangngotan95/go-m3u8/m3u8"
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4"
 	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
 )
 
 // HLSPuller HLS拉流者
@@ -27,7 +28,15 @@ type HLSPuller struct {
 	Audio       M3u8Info
 	TsHead      http.Header     `json:"-" yaml:"-"` //用于提供cookie等特殊身份的http头
 	SaveContext context.Context `json:"-" yaml:"-"` //用来保存ts文件到服务器
+	Loop        bool            //点播m3u8播放完之后从头循环
+	Variant     string          //选择变体的策略，为空时使用配置中的 variant
+	Language    string          //优先选择的音轨和字幕语言，逗号分隔，为空时使用配置中的 language
+	MultiAudio  bool            //把其他语言的音轨也拉取为单独的轨道
+	Backups     []string        //备用地址，拉流地址出错、停止更新或超时时按顺序切换
+	Retry       *RetryPolicy    //重试策略，为空时使用配置中的 retry
+	Renditions  []*M3u8Info     //单独作为轨道的音轨和导入的字幕
 	memoryTs    util.Map[string, util.Recyclable]
+	demux       *demuxFeeder // 音视频分离时两边的切片交错后一起解析
 }
 
 // M3u8Info m3u8文件的信息，用于拉取m3u8文件，和提供查询
@@ -36,35 +45,177 @@ type M3u8Info struct {
 	M3U8Count int           //一共拉取的m3u8文件数量
 	TSCount   int           //一共拉取的ts文件数量
 	LastM3u8  string        //最后一个m3u8文件内容
+	Name      string        //音轨或字幕的名称
+	recorder  *tsRecorder
+	reader    renditionReader
+}
+
+// tsRecorder 保存时把所有ts追加到同一个文件中，结束时生成用 #EXT-X-BYTERANGE 描述的点播m3u8
+type tsRecorder struct {
+	ts       *os.File
+	m3u8Path string
+	playlist m3u8.MediaPlaylist
+	tsName   string
+	offset   int64 // 当前切片在文件中的起始位置
+	size     int64
+}
+
+func newTsRecorder(dir string, name string) (r *tsRecorder, err error) {
+	if err = os.MkdirAll(dir, 0766); err != nil {
+		return
+	}
+	r = &tsRecorder{
+		tsName:   name + ".ts",
+		m3u8Path: filepath.Join(dir, name+".m3u8"),
+		playlist: m3u8.MediaPlaylist{Version: 4, PlaylistType: m3u8.PLAYLIST_TYPE_VOD, EndList: true},
+	}
+	r.ts, err = os.OpenFile(filepath.Join(dir, r.tsName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	return
+}
+
+func (r *tsRecorder) Write(b []byte) (n int, err error) {
+	n, err = r.ts.Write(b)
+	r.size += int64(n)
+	return
+}
+
+// segment 把上次调用之后写入的数据作为一个切片，目标时长取最长的切片
+func (r *tsRecorder) segment(dur float64) {
+	if r.size > r.offset {
+		r.playlist.Segments = append(r.playlist.Segments, &m3u8.Segment{
+			URI:       r.tsName,
+			Duration:  dur,
+			ByteRange: &m3u8.ByteRange{Length: r.size - r.offset, Offset: r.offset},
+		})
+		if target := int(math.Ceil(dur)); target > r.playlist.TargetDuration {
+			r.playlist.TargetDuration = target
+		}
+		r.offset = r.size
+	}
+}
+
+// Close 录制结束后才写入m3u8，点播播放列表的内容不会再变化
+func (r *tsRecorder) Close() {
+	r.ts.Close()
+	if len(r.playlist.Segments) == 0 {
+		return
+	}
+	if err := os.WriteFile(r.m3u8Path, []byte(r.playlist.String()), 0666); err != nil {
+		HLSPlugin.Error("record", zap.String("path", r.m3u8Path), zap.Error(err))
+	}
 }
 
 type TSDownloader struct {
-	client *http.Client
-	url    *url.URL
-	req    *http.Request
-	res    *http.Response
-	wg     sync.WaitGroup
-	err    error
-	dur    float64
+	client    *http.Client
+	url       *url.URL
+	req       *http.Request
+	res       *http.Response
+	wg        sync.WaitGroup
+	err       error
+	dur       float64
+	uri       string
+	byteRange *m3u8.ByteRange
+	key       *m3u8.Key // 切片使用的密钥
+	sequence  int       // 切片的媒体序号
+	aesKey    []byte
+	iv        []byte
+	initMap   *m3u8.Map // fMP4 切片的 #EXT-X-MAP
+	fmp4      *fmp4Init
+	// 点播切片需要按时间戳发布，先完整下载到内存，避免长时间不读取导致连接超时
+	buffered      bool
+	discontinuity bool
 }
 
 func (p *TSDownloader) Start() {
 	p.wg.Add(1)
 	go func() {
 		defer p.wg.Done()
-		if tsRes, err := p.client.Do(p.req); err == nil {
+		if tsRes, err := p.client.Do(p.req); err != nil {
+			p.err = err
+		} else if p.byteRange != nil && tsRes.StatusCode != http.StatusPartialContent {
+			// 服务器忽略了 Range 时返回的是整个文件
+			tsRes.Body.Close()
+			p.err = fmt.Errorf("fetch %s: %s, want 206 for range request", p.url, tsRes.Status)
+		} else if body, err := p.open(tsRes.Body); err == nil {
+			tsRes.Body = body
 			p.res = tsRes
 		} else {
+			tsRes.Body.Close()
 			p.err = err
 		}
 	}()
 }
 
+// rangeHeader 有 #EXT-X-BYTERANGE 时复制一份http头并加上 Range
+func rangeHeader(header http.Header, r *m3u8.ByteRange) http.Header {
+	if r == nil {
+		return header
+	}
+	if header = header.Clone(); header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Range", "bytes="+strconv.FormatInt(r.Offset, 10)+"-"+strconv.FormatInt(r.Offset+r.Length-1, 10))
+	return header
+}
+
+// reloadInterval 按 RFC 8216 6.3.4，播放列表有变化时从开始请求算起间隔一个目标时长再刷新，没有变化时间隔一半
+func reloadInterval(targetDuration int, changed bool) time.Duration {
+	d := time.Duration(targetDuration) * time.Second
+	if d <= 0 {
+		d = time.Second
+	}
+	if !changed {
+		d /= 2
+	}
+	return d
+}
+
+// fetchBytes 下载密钥、初始化片段等较小的资源，超过 limit 字节时返回错误，请求了 Range 时只接受 206
+func fetchBytes(ctx context.Context, client *http.Client, rawURL string, header http.Header, limit int64) (data []byte, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header = header
+	res, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if header.Get("Range") != "" {
+		if res.StatusCode != http.StatusPartialContent {
+			return nil, fmt.Errorf("fetch %s: %s, want 206 for range request", rawURL, res.Status)
+		}
+	} else if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", rawURL, res.Status)
+	}
+	if data, err = io.ReadAll(io.LimitReader(res.Body, limit+1)); err == nil && int64(len(data)) > limit {
+		return nil, fmt.Errorf("fetch %s: larger than %d bytes", rawURL, limit)
+	}
+	return
+}
+
+// newPullClient 配置了代理时使用代理下载
+func newPullClient(proxy string) (*http.Client, error) {
+	if proxy == "" {
+		return http.DefaultClient, nil
+	}
+	URL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(URL),
+		},
+	}, nil
+}
+
 func (p *HLSPuller) GetTs(key string) util.Recyclable {
 	return p.memoryTs.Get(key)
 }
 
-func readM3U8(res *http.Response) (playlist *m3u8.Playlist, err error) {
+func readM3U8(res *http.Response) (playlist m3u8.Playlist, err error) {
 	var reader io.Reader = res.Body
 	if res.Header.Get("Content-Encoding") == "gzip" {
 		reader, err = gzip.NewReader(reader)
@@ -77,17 +228,30 @@ func readM3U8(res *http.Response) (playlist *m3u8.Playlist, err error) {
 	}
 	return
 }
+
+// startPull 发布之前设置发布超时，重试期间和纯转发时引擎不会因为没有数据关闭流，不在拉流协程中修改流的状态
+func startPull(streamPath, url string, puller *HLSPuller, save int) error {
+	conf := hlsConfig.Publish
+	if window, ok := puller.retryPolicy().window(); hlsConfig.RelayMode != 0 || !ok {
+		conf.PublishTimeout = math.MaxInt64
+	} else if conf.PublishTimeout < math.MaxInt64-window {
+		conf.PublishTimeout += window
+	}
+	puller.Publisher.Config = &conf
+	return HLSPlugin.Pull(streamPath, url, puller, save)
+}
+
 func (p *HLSPuller) OnEvent(event any) {
 	switch event.(type) {
 	case IPublisher:
 		p.TSPublisher.OnEvent(event)
 		if hlsConfig.RelayMode != 0 {
-			p.Stream.NeverTimeout = true
 			memoryTs.Add(p.StreamPath, p)
 		}
 	case SEKick, SEclose:
 		if hlsConfig.RelayMode == 1 {
 			memoryTs.Delete(p.StreamPath)
+			hlsNotifier.Notify(p.Stream.Path, p.StreamPath)
 		}
 		p.Publisher.OnEvent(event)
 	default:
@@ -97,142 +261,283 @@ func (p *HLSPuller) OnEvent(event any) {
 func (p *HLSPuller) pull(info *M3u8Info) (err error) {
 	//请求失败自动退出
 	req := info.Req.WithContext(p.Context)
-	client := http.DefaultClient
-	if p.Puller.Config.Proxy != "" {
-		URL, err := url.Parse(p.Puller.Config.Proxy)
-		if err != nil {
-			return err
-		}
-		client = &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(URL),
-			},
-		}
+	client, err := newPullClient(p.Puller.Config.Proxy)
+	if err != nil {
+		return
 	}
 	sequence := -1
 	lastTs := make(map[string]bool)
 	tsbuffer := make(chan io.ReadCloser)
 	bytesPool := make(util.BytesPool, 30)
 	tsRing := util.NewRing[string](6)
+	var keys segmentKeys
+	var inits fmp4Inits
+	var ll llhlsPuller
 	var tsReader *TSReader
-	if hlsConfig.RelayMode != 1 {
-		tsReader = NewTSReader(&p.TSPublisher)
-		defer tsReader.Close()
+	// 单独作为轨道的音轨和字幕不参与转发
+	relay := hlsConfig.RelayMode != 0 && info.reader == nil
+	// 音轨转发的播放列表为 streamPath/audio.m3u8，切片位于 streamPath/audio/ 下，不覆盖视频的播放列表
+	relayName, relayDir := p.Stream.Path, ""
+	if info == &p.Audio {
+		relayName, relayDir = p.Stream.Path+"/audio", "audio/"
 	}
 	defer func() {
 		HLSPlugin.Info("hls exit", zap.String("streamPath", p.Stream.Path), zap.Error(err))
+		if tsReader != nil {
+			tsReader.Close()
+		}
+		if p.demux != nil && (info == &p.Video || info == &p.Audio) {
+			p.demux.end(p, info == &p.Audio)
+		}
+		if info.recorder != nil {
+			info.recorder.Close()
+			info.recorder = nil
+		}
 		close(tsbuffer)
 		p.Stop()
 	}()
-	var maxResolution *m3u8.PlaylistItem
+	var vod vodPlayer
+	up := newUpstreams(req, nil)
+	if info == &p.Video {
+		up = newUpstreams(req, p.backupURLs())
+	}
+	// failover 切换上游之后重新开始，避免把新上游的切片当作已经下载过
+	failover := func(reason error) bool {
+		next := up.failover(p, reason)
+		if next == nil {
+			return false
+		}
+		req = next
+		sequence = -1
+		lastTs = make(map[string]bool)
+		ll = llhlsPuller{}
+		inits = fmp4Inits{}
+		return true
+	}
+	retry := retrier{policy: p.retryPolicy()}
+	var loadStart, reloadAt time.Time
 	for errcount := 0; err == nil; err = p.Err() {
-		resp, err1 := client.Do(req)
-		if err1 != nil {
-			return err1
+		var playlist m3u8.Playlist
+		var err2 error
+		if vod.media != nil {
+			// 点播的播放列表不会变化，只请求一次
+			playlist = vod.media
+		} else {
+			if d := time.Until(reloadAt); d > 0 {
+				select {
+				case <-p.Done():
+					continue
+				case <-time.After(d):
+				}
+			}
+			reloadAt, loadStart = time.Time{}, time.Now()
+			ctx, cancel := context.WithTimeout(p.Context, up.timeout)
+			resp, err1 := client.Do(req.WithContext(ctx))
+			if err1 == nil {
+				req = resp.Request
+				if resp.StatusCode != http.StatusOK {
+					err1 = fmt.Errorf("fetch %s: %s", req.URL, resp.Status)
+				} else {
+					playlist, err2 = readM3U8(resp)
+				}
+				resp.Body.Close()
+			}
+			cancel()
+			if err1 != nil {
+				if p.Err() == nil && (failover(err1) || retry.wait(p, err1)) {
+					continue
+				}
+				return err1
+			}
+			retry.reset(p)
 		}
-		req = resp.Request
-		if playlist, err2 := readM3U8(resp); err2 == nil {
+		if err2 == nil {
 			errcount = 0
-			info.LastM3u8 = playlist.String()
-			//if !playlist.Live {
+			m3u8Text := playlist.String()
+			changed := m3u8Text != info.LastM3u8
+			info.LastM3u8 = m3u8Text
+			if master, ok := playlist.(*m3u8.MasterPlaylist); ok {
+				variant, err := selectVariant(master.Variants, p.variantPolicy())
+				if err != nil {
+					return err
+				}
+				HLSPlugin.Info("select variant", zap.String("streamPath", p.Stream.Path), zap.String("uri", variant.URI), zap.Int("bandwidth", variant.Bandwidth), zap.Int("width", variant.Width), zap.Int("height", variant.Height))
+				if p.Audio.Req == nil && p.Renditions == nil {
+					p.pullRenditions(master, variant, req)
+				}
+				up.redundant(req, variant, master.Variants)
+				url, err := req.URL.Parse(variant.URI)
+				if err != nil {
+					return err
+				}
+				p.Video.Req, _ = http.NewRequest("GET", url.String(), nil)
+				p.Video.Req.Header = req.Header
+				req = p.Video.Req
+				continue
+			}
+			media := playlist.(*m3u8.MediaPlaylist)
+			//if media.EndList {
 			//	log.Println(p.LastM3u8)
 			//	return
 			//}
-			if playlist.Sequence <= sequence {
-				HLSPlugin.Warn("same sequence", zap.Int("sequence", playlist.Sequence), zap.Int("max", sequence))
-				time.Sleep(time.Second)
+			lowLatency := isLowLatency(media)
+			if media.EndList {
+				if vod.media == nil {
+					HLSPlugin.Info("vod", zap.String("streamPath", p.Stream.Path), zap.Int("segments", len(media.Segments)), zap.Bool("loop", p.Loop || hlsConfig.VodLoop))
+				}
+			} else if !lowLatency && (media.MediaSequence < sequence || media.MediaSequence == sequence && !changed) {
+				HLSPlugin.Debug("same sequence", zap.Int("sequence", media.MediaSequence), zap.Int("max", sequence))
+				if up.stalled(media.TargetDuration) && failover(ErrPlaylistStalled) {
+					continue
+				}
+				up.success(false, media.TargetDuration)
+				reloadAt = loadStart.Add(reloadInterval(media.TargetDuration, false))
 				continue
 			}
+			up.success(true, media.TargetDuration)
+			if !media.EndList && !lowLatency {
+				reloadAt = loadStart.Add(reloadInterval(media.TargetDuration, true))
+			}
 			info.M3U8Count++
-			sequence = playlist.Sequence
-			thisTs := make(map[string]bool)
-			tsItems := make([]*m3u8.SegmentItem, 0)
-			discontinuity := false
-			for _, item := range playlist.Items {
-				switch v := item.(type) {
-				case *m3u8.PlaylistItem:
-					if (maxResolution == nil || maxResolution.Resolution != nil && (maxResolution.Resolution.Width < v.Resolution.Width || maxResolution.Resolution.Height < v.Resolution.Height)) || maxResolution.Bandwidth < v.Bandwidth {
-						maxResolution = v
+			sequence = media.MediaSequence
+			var tsItems []*TSDownloader
+			if media.EndList {
+				if tsItems = vod.items(client, media, p.Loop || hlsConfig.VodLoop); len(tsItems) == 0 {
+					// 点播播放完毕
+					return
+				}
+			} else if lowLatency {
+				// 低延迟HLS下载新的部分切片，下一次使用阻塞刷新
+				tsItems = ll.items(client, media)
+				req = ll.reload(req)
+				HLSPlugin.Debug("readM3U8", zap.Int("sequence", sequence), zap.Int("parts", len(tsItems)))
+				if len(tsItems) == 0 {
+					// 上游没有阻塞时至少等待一个部分切片的时长再刷新
+					reloadAt = loadStart.Add(time.Duration(media.PartTargetDuration * float64(time.Second)))
+					continue
+				}
+			} else {
+				thisTs := make(map[string]bool)
+				discontinuity := false
+				var key *m3u8.Key
+				var initMap *m3u8.Map
+				for i, v := range media.Segments {
+					if v.Key != nil {
+						key = v.Key
 					}
-				case *m3u8.DiscontinuityItem:
-					discontinuity = true
-				case *m3u8.SegmentItem:
-					thisTs[v.Segment] = true
-					if _, ok := lastTs[v.Segment]; ok && !discontinuity {
-						continue
+					if v.Map != nil {
+						initMap = v.Map
 					}
-					tsItems = append(tsItems, v)
-				case *m3u8.MediaItem:
-					if p.Audio.Req == nil {
-						if url, err := req.URL.Parse(*v.URI); err == nil {
-							newReq, _ := http.NewRequest("GET", url.String(), nil)
-							newReq.Header = req.Header
-							p.Audio.Req = newReq
-							go p.pull(&p.Audio)
-						}
+					if v.Discontinuity {
+						discontinuity = true
 					}
-				}
-			}
-			if maxResolution != nil && len(tsItems) == 0 {
-				if url, err := req.URL.Parse(maxResolution.URI); err == nil {
-					if strings.HasSuffix(url.Path, ".m3u8") {
-						p.Video.Req, _ = http.NewRequest("GET", url.String(), nil)
-						p.Video.Req.Header = req.Header
-						req = p.Video.Req
+					id := v.URI
+					if v.ByteRange != nil {
+						id += "@" + v.ByteRange.String()
+					}
+					thisTs[id] = true
+					if _, ok := lastTs[id]; ok && !discontinuity {
 						continue
 					}
+					tsItems = append(tsItems, &TSDownloader{
+						client:    client,
+						uri:       v.URI,
+						byteRange: v.ByteRange,
+						dur:       v.Duration,
+						key:       key,
+						sequence:  media.MediaSequence + i,
+						initMap:   initMap,
+					})
+				}
+				tsCount := len(tsItems)
+				HLSPlugin.Debug("readM3U8", zap.Int("sequence", sequence), zap.Int("tscount", tsCount))
+				lastTs = thisTs
+				if tsCount > 3 {
+					tsItems = tsItems[tsCount-3:]
 				}
 			}
-			tsCount := len(tsItems)
-			HLSPlugin.Debug("readM3U8", zap.Int("sequence", sequence), zap.Int("tscount", tsCount))
-			lastTs = thisTs
-			if tsCount > 3 {
-				tsItems = tsItems[tsCount-3:]
+			if up.switched && len(tsItems) > 0 {
+				tsItems[0].discontinuity = true
+				up.switched = false
 			}
 			var plBuffer util.Buffer
 			relayPlayList := Playlist{
 				Writer:         &plBuffer,
-				Targetduration: playlist.Target,
-				Sequence:       playlist.Sequence,
+				Targetduration: media.TargetDuration,
+				Sequence:       media.MediaSequence,
 			}
-			if hlsConfig.RelayMode != 0 {
+			if media.EndList {
+				// 转发点播时按下载的顺序编号
+				relayPlayList.Sequence = vod.relayed
+				vod.relayed += len(tsItems)
+			}
+			if relay {
 				relayPlayList.Init()
 			}
-			var tsDownloaders = make([]*TSDownloader, len(tsItems))
-			for i, v := range tsItems {
+			var tsDownloaders = tsItems
+			for _, v := range tsDownloaders {
 				if p.Err() != nil {
 					return p.Err()
 				}
-				tsUrl, _ := info.Req.URL.Parse(v.Segment)
-				tsReq, _ := http.NewRequestWithContext(p.Context, "GET", tsUrl.String(), nil)
-				tsReq.Header = p.TsHead
+				v.url, _ = req.URL.Parse(v.uri)
+				v.req, _ = http.NewRequestWithContext(p.Context, "GET", v.url.String(), nil)
+				v.req.Header = rangeHeader(p.TsHead, v.byteRange)
 				// t1 := time.Now()
-				tsDownloaders[i] = &TSDownloader{
-					client: client,
-					req:    tsReq,
-					url:    tsUrl,
-					dur:    v.Duration,
+				if v.aesKey, v.iv, v.err = keys.get(p, client, req, v.key, v.sequence); v.err != nil {
+					continue
+				}
+				if v.fmp4, v.err = inits.get(p, client, req, v.initMap, v.key, v.aesKey, v.iv); v.err == nil {
+					v.Start()
 				}
-				tsDownloaders[i].Start()
 			}
+			keys.refresh()
+			downloaded := 0
 			ts := time.Now().UnixMilli()
 			for i, v := range tsDownloaders {
 				HLSPlugin.Debug("start download ts", zap.String("tsUrl", v.url.String()))
 				v.wg.Wait()
 				if v.res != nil {
 					info.TSCount++
-					p.SetIO(v.res.Body)
-					if p.SaveContext != nil && p.SaveContext.Err() == nil {
+					downloaded++
+					if _, vtt := info.reader.(*subtitleRendition); media.EndList && !vtt {
+						v.res.Body = vod.pace(p.Context, v.res.Body, v.discontinuity)
+					}
+					// 视频、音轨和字幕在各自的协程中下载，每个切片使用自己的 reader，不能共用 p.IO
+					var reader io.Reader = v.res.Body
+					var file *os.File
+					saving := p.SaveContext != nil && p.SaveContext.Err() == nil
+					if !saving && info.recorder != nil {
+						info.recorder.Close()
+						info.recorder = nil
+					}
+					if saving && hlsConfig.SingleFile {
+						if info.recorder == nil {
+							name := strconv.FormatInt(time.Now().Unix(), 10)
+							if info == &p.Audio {
+								name += "_audio"
+							} else if info.reader != nil {
+								name += "_" + url.PathEscape(info.Name)
+							}
+							if recorder, err := newTsRecorder(filepath.Join(hlsConfig.Path, p.Stream.Path), name); err == nil {
+								info.recorder = recorder
+							} else {
+								HLSPlugin.Error("record", zap.String("streamPath", p.Stream.Path), zap.Error(err))
+							}
+						}
+						if info.recorder != nil {
+							reader = io.TeeReader(v.res.Body, info.recorder)
+						}
+					} else if saving {
 						os.MkdirAll(filepath.Join(hlsConfig.Path, p.Stream.Path), 0766)
 						if f, err := os.OpenFile(filepath.Join(hlsConfig.Path, p.Stream.Path, filepath.Base(v.url.Path)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666); err == nil {
-							p.SetIO(io.TeeReader(v.res.Body, f))
-							p.Closer = f
+							reader = io.TeeReader(v.res.Body, f)
+							file = f
 						}
 					}
 					var tsBytes *util.Buffer
 					var item *util.ListItem[util.Buffer]
 					// 包含转发
-					if hlsConfig.RelayMode != 0 {
+					if relay {
 						if v.res.ContentLength < 0 {
 							item = bytesPool.GetShell(make([]byte, 0))
 						} else {
@@ -241,22 +546,42 @@ func (p *HLSPuller) pull(info *M3u8Info) (err error) {
 						}
 						tsBytes = &item.Value
 					}
-					switch hlsConfig.RelayMode {
-					case 1:
-						io.Copy(tsBytes, p.Reader)
-					case 2:
-						p.SetIO(io.TeeReader(p.Reader, tsBytes))
+					switch {
+					case info.reader != nil:
+						if err := info.reader.feed(p, reader); err != nil {
+							HLSPlugin.Warn("rendition", zap.String("streamPath", p.Stream.Path), zap.String("name", info.Name), zap.Error(err))
+						}
+					case hlsConfig.RelayMode == 1:
+						io.Copy(tsBytes, reader)
+					case hlsConfig.RelayMode == 2:
+						reader = io.TeeReader(reader, tsBytes)
 						fallthrough
-					case 0:
-						tsReader.Feed(p)
+					default:
+						if p.demux != nil && (info == &p.Video || info == &p.Audio) {
+							// 音视频分离时按时间戳交错后再解析
+							if err := p.demux.push(p, info == &p.Audio, reader); err != nil {
+								HLSPlugin.Error("demux", zap.String("streamPath", p.Stream.Path), zap.Error(err))
+							}
+						} else {
+							if tsReader == nil {
+								tsReader = NewTSReader(&p.TSPublisher)
+							}
+							tsReader.Feed(reader)
+						}
 					}
-					if hlsConfig.RelayMode != 0 {
-						tsFilename := fmt.Sprintf("%d_%d.ts", ts, i)
+					if relay {
+						tsFilename := relayDir + fmt.Sprintf("%d_%d.ts", ts, i)
 						tsFilePath := p.StreamPath + "/" + tsFilename
+						title := p.Stream.StreamName + "/" + tsFilename
+						if relayDir != "" {
+							title = tsFilename
+						}
 						var plInfo = PlaylistInf{
-							Title:    p.Stream.StreamName + "/" + tsFilename,
+							Title:    title,
 							Duration: v.dur,
 							FilePath: tsFilePath,
+							// 点播循环或切换上游之后时间戳不连续
+							Discontinuity: v.discontinuity,
 						}
 						relayPlayList.WriteInf(plInfo)
 						p.memoryTs.Add(tsFilePath, item)
@@ -272,7 +597,13 @@ func (p *HLSPuller) pull(info *M3u8Info) (err error) {
 						next.Value = tsFilePath
 						tsRing = next
 					}
-					p.Close()
+					v.res.Body.Close()
+					if file != nil {
+						file.Close()
+					}
+					if saving && info.recorder != nil {
+						info.recorder.segment(v.dur)
+					}
 				} else if v.err != nil {
 					HLSPlugin.Error("reqTs", zap.String("streamPath", p.Stream.Path), zap.Error(v.err))
 				} else {
@@ -280,13 +611,25 @@ func (p *HLSPuller) pull(info *M3u8Info) (err error) {
 				}
 				HLSPlugin.Debug("finish download ts", zap.String("tsUrl", v.url.String()))
 			}
-			if hlsConfig.RelayMode != 0 {
-				m3u8 := string(plBuffer)
-				HLSPlugin.Debug("write m3u8", zap.String("streamPath", p.Stream.Path), zap.String("m3u8", m3u8))
-				memoryM3u8.Store(p.Stream.Path, m3u8)
+			if relay {
+				relayM3u8 := string(plBuffer)
+				HLSPlugin.Debug("write m3u8", zap.String("streamPath", relayName), zap.String("m3u8", relayM3u8))
+				memoryM3u8.Store(relayName, relayM3u8)
+				if relayDir != "" {
+					hlsNotifier.Notify(relayName)
+				} else {
+					hlsNotifier.Notify(p.Stream.Path, p.StreamPath)
+					notifyLadder(p.Stream.Path)
+				}
+			}
+			if downloaded == 0 && len(tsDownloaders) > 0 && p.Err() == nil {
+				failover(ErrSegmentsFailed)
 			}
 		} else {
 			HLSPlugin.Error("readM3u8", zap.String("streamPath", p.Stream.Path), zap.Error(err2))
+			if failover(err2) {
+				continue
+			}
 			errcount++
 			if errcount > 10 {
 				return err2
@@ -296,6 +639,63 @@ func (p *HLSPuller) pull(info *M3u8Info) (err error) {
 	return
 }
 
+// pullRenditions 拉取变体引用的音轨，开启 multiaudio 时其他音轨作为单独的轨道，配置了 subtitle 时导入字幕
+func (p *HLSPuller) pullRenditions(master *m3u8.MasterPlaylist, variant *m3u8.Variant, req *http.Request) {
+	newInfo := func(r *m3u8.Rendition) *M3u8Info {
+		url, err := req.URL.Parse(r.URI)
+		if err != nil {
+			HLSPlugin.Error("rendition", zap.String("streamPath", p.Stream.Path), zap.String("uri", r.URI), zap.Error(err))
+			return nil
+		}
+		info := &M3u8Info{Name: r.Name}
+		info.Req, _ = http.NewRequest("GET", url.String(), nil)
+		info.Req.Header = req.Header
+		return info
+	}
+	languages := p.preferredLanguages()
+	audio, others := selectRendition(master, m3u8.MEDIA_TYPE_AUDIO, variant.Audio, languages)
+	if audio != nil && audio.URI != "" {
+		if info := newInfo(audio); info != nil {
+			HLSPlugin.Info("select audio", zap.String("streamPath", p.Stream.Path), zap.String("name", audio.Name), zap.String("language", audio.Language))
+			p.Audio = *info
+			if hlsConfig.RelayMode != 1 {
+				p.demux = newDemuxFeeder()
+			}
+			go p.pull(&p.Audio)
+		}
+	}
+	if hlsConfig.RelayMode == 1 {
+		return
+	}
+	if p.MultiAudio || hlsConfig.MultiAudio {
+		for i, r := range others {
+			if info := newInfo(r); info != nil {
+				info.reader = &audioRendition{name: renditionTrackName(r, i), pmtPID: -1, audioPID: -1}
+				p.Renditions = append(p.Renditions, info)
+			}
+		}
+	}
+	if hlsConfig.Subtitle != "" {
+		subtitle, _ := selectRendition(master, m3u8.MEDIA_TYPE_SUBTITLES, variant.Subtitles, append(languages, hlsConfig.Subtitle))
+		if subtitle != nil && subtitle.URI != "" {
+			if info := newInfo(subtitle); info != nil {
+				info.reader = new(subtitleRendition)
+				p.Renditions = append(p.Renditions, info)
+			}
+		}
+	}
+	for _, info := range p.Renditions {
+		go p.pull(info)
+	}
+}
+
+func (p *HLSPuller) variantPolicy() string {
+	if p.Variant != "" {
+		return p.Variant
+	}
+	return hlsConfig.Variant
+}
+
 func (p *HLSPuller) Connect() (err error) {
 	p.Video.Req, err = http.NewRequest("GET", p.RemoteURL, nil)
 	return
@@ -0,0 +1,274 @@
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// selectRendition 从变体引用的组中选择一个 #EXT-X-MEDIA，依次按优先的语言、DEFAULT 和出现的顺序，同时返回组中其他有 URI 的项
+func selectRendition(master *m3u8.MasterPlaylist, mediaType, groupID string, languages []string) (selected *m3u8.Rendition, others []*m3u8.Rendition) {
+	if groupID == "" || groupID == "NONE" {
+		return
+	}
+	var group []*m3u8.Rendition
+	for _, r := range master.Renditions {
+		if r.Type == mediaType && r.GroupID == groupID {
+			group = append(group, r)
+		}
+	}
+	for _, language := range languages {
+		for _, r := range group {
+			if matchLanguage(r.Language, language) {
+				selected = r
+				break
+			}
+		}
+		if selected != nil {
+			break
+		}
+	}
+	for _, r := range group {
+		if selected == nil && r.Default {
+			selected = r
+		}
+	}
+	if selected == nil && len(group) > 0 {
+		selected = group[0]
+	}
+	for _, r := range group {
+		if r != selected && r.URI != "" {
+			others = append(others, r)
+		}
+	}
+	return
+}
+
+// matchLanguage 语言标签不区分大小写，zh 可以匹配 zh-CN
+func matchLanguage(tag, language string) bool {
+	tag, language = strings.ToLower(tag), strings.ToLower(strings.TrimSpace(language))
+	return language != "" && (tag == language || strings.HasPrefix(tag, language+"-"))
+}
+
+// preferredLanguages 拉流时优先选择的语言，逗号分隔
+func (p *HLSPuller) preferredLanguages() []string {
+	if p.Language != "" {
+		return strings.Split(p.Language, ",")
+	}
+	if hlsConfig.Language != "" {
+		return strings.Split(hlsConfig.Language, ",")
+	}
+	return nil
+}
+
+// renditionReader 读取单独作为轨道的音轨或导入的字幕，这些切片不参与转发
+type renditionReader interface {
+	feed(p *HLSPuller, r io.Reader) error
+}
+
+// audioRendition 把其他语言的音轨解析成单独的 AAC 轨道
+type audioRendition struct {
+	name     string
+	track    *track.AAC
+	pmtPID   int
+	audioPID int
+	pes      []byte
+}
+
+// renditionTrackName 用语言或名称区分轨道，例如 aac_en
+func renditionTrackName(r *m3u8.Rendition, i int) string {
+	name := r.Language
+	if name == "" {
+		name = r.Name
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '?' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = strconv.Itoa(i)
+	}
+	return "aac_" + name
+}
+
+func (a *audioRendition) feed(p *HLSPuller, r io.Reader) (err error) {
+	var packet [mpegts.TS_PACKET_SIZE]byte
+	for {
+		if _, err = io.ReadFull(r, packet[:]); err != nil {
+			break
+		}
+		if packet[0] != 0x47 {
+			return ErrInvalidTsPacket
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		pusi := packet[1]&0x40 != 0
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if int(payload[0]) >= len(payload) {
+				return ErrInvalidTsPacket
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if packet[3]&0x10 == 0 {
+			continue
+		}
+		switch {
+		case pid == 0 && pusi:
+			a.pmtPID = parsePAT(psiSection(payload))
+		case pid == a.pmtPID && pusi:
+			a.audioPID = pmtAAC(psiSection(payload))
+		case pid == a.audioPID:
+			if pusi {
+				a.flush(p)
+				a.pes = append(a.pes[:0], payload...)
+			} else if len(a.pes) > 0 {
+				a.pes = append(a.pes, payload...)
+			}
+		}
+	}
+	a.flush(p)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+// pmtAAC 返回PMT中第一个 AAC 流的PID
+func pmtAAC(section []byte) int {
+	pmt, _ := parsePMT(section)
+	for _, s := range pmt.streams {
+		if s.streamType == mpegts.STREAM_TYPE_AAC {
+			return int(s.pid)
+		}
+	}
+	return -1
+}
+
+// flush 把拼接完整的PES中的 ADTS 写入轨道
+func (a *audioRendition) flush(p *HLSPuller) {
+	data := a.pes
+	a.pes = a.pes[:0]
+	if len(data) < 14 || data[0] != 0 || data[1] != 0 || data[2] != 1 || data[7]&0x80 == 0 || 9+int(data[8]) > len(data) {
+		return
+	}
+	if a.track == nil {
+		a.track = track.NewAAC(p, a.name)
+		p.Info("rendition track", zap.String("name", a.name))
+	}
+	a.track.WriteADTS(uint32(getTimestamp(data[9:])), util.ReuseBuffer{Buffer: data[9+int(data[8]):]})
+}
+
+// subtitleRendition 导入 WebVTT 字幕，需要配置 subtitle 让写入者输出字幕
+type subtitleRendition struct {
+	last map[vttCue]bool // 上一个切片中的字幕，跨切片的字幕只导入一次
+}
+
+// vttCue 用PTS（90kHz）表示时间的字幕
+type vttCue struct {
+	start, end uint64
+	text       string
+}
+
+func (s *subtitleRendition) feed(p *HLSPuller, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	hls, ok := memoryTs.Get(p.Stream.Path).(*HLSWriter)
+	if !ok {
+		// 没有正在写入的HLS流，丢弃字幕
+		return nil
+	}
+	cues := make(map[vttCue]bool)
+	for _, cue := range parseWebVTT(data) {
+		cues[cue] = true
+		if !s.last[cue] && !hls.pushSubtitlePTS(cue) {
+			// 没有字幕播放列表，丢弃字幕
+			return nil
+		}
+	}
+	s.last = cues
+	return nil
+}
+
+// parseWebVTT 解析 WebVTT 切片，按 X-TIMESTAMP-MAP 把时间换算成PTS
+func parseWebVTT(data []byte) (cues []vttCue) {
+	var mpegtsBase, local time.Duration
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	var cue *vttCue
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, "X-TIMESTAMP-MAP="):
+			for _, kv := range strings.Split(strings.TrimPrefix(line, "X-TIMESTAMP-MAP="), ",") {
+				k, v, _ := strings.Cut(kv, ":")
+				switch k {
+				case "MPEGTS":
+					ts, _ := strconv.ParseInt(v, 10, 64)
+					mpegtsBase = time.Duration(ts) * time.Second / 90000
+				case "LOCAL":
+					local, _ = parseVTTTime(v)
+				}
+			}
+		case strings.Contains(line, "-->"):
+			from, to, _ := strings.Cut(line, "-->")
+			cue = nil
+			if fields := strings.Fields(to); len(fields) > 0 {
+				start, err1 := parseVTTTime(strings.TrimSpace(from))
+				end, err2 := parseVTTTime(fields[0])
+				if err1 == nil && err2 == nil {
+					cue = &vttCue{
+						start: uint64((mpegtsBase + start - local).Milliseconds() * 90),
+						end:   uint64((mpegtsBase + end - local).Milliseconds() * 90),
+					}
+				}
+			}
+		case line == "":
+			if cue != nil && cue.text != "" {
+				cues = append(cues, *cue)
+			}
+			cue = nil
+		case cue != nil:
+			if cue.text != "" {
+				cue.text += "\n"
+			}
+			cue.text += line
+		}
+	}
+	if cue != nil && cue.text != "" {
+		cues = append(cues, *cue)
+	}
+	return
+}
+
+// parseVTTTime 解析 hh:mm:ss.ttt 或 mm:ss.ttt
+func parseVTTTime(value string) (t time.Duration, err error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, strconv.ErrSyntax
+	}
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return
+	}
+	t = time.Duration(seconds * float64(time.Second))
+	for i, unit := len(parts)-2, time.Minute; i >= 0; i, unit = i-1, unit*60 {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, err
+		}
+		t += time.Duration(n) * unit
+	}
+	return
+}
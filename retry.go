@@ -0,0 +1,122 @@
+package hls
+
+import (
+	"math"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/plugin/hls/v4/backoff"
+)
+
+// RetryPolicy 拉取播放列表出错并且没有可切换的上游时的重试策略
+type RetryPolicy struct {
+	MaxRetries int           `default:"5" desc:"最大重试次数，0为不重试，-1为不限次数"`
+	Backoff    time.Duration `default:"1s" desc:"第一次重试前的等待时间，之后每次翻倍"`
+	MaxBackoff time.Duration `default:"30s" desc:"翻倍的上限，0为不限"`
+	MaxDelay   time.Duration `default:"5m" desc:"加上随机浮动之后等待时间的上限，0为不限"`
+	Jitter     float64       `default:"0.2" desc:"等待时间随机浮动的比例"`
+	GiveUp     time.Duration `desc:"连续失败超过该时长后放弃，0为不限"`
+}
+
+// parseRetryPolicy 用请求参数 retry、backoff、maxbackoff、maxdelay、jitter、giveup 覆盖配置中的重试策略，都没有时返回 nil
+func parseRetryPolicy(query url.Values) (policy *RetryPolicy, err error) {
+	set := func(name string, parse func(string) error) {
+		if value := query.Get(name); value != "" && err == nil {
+			if policy == nil {
+				copied := hlsConfig.Retry
+				policy = &copied
+			}
+			err = parse(value)
+		}
+	}
+	set("retry", func(v string) (err error) {
+		policy.MaxRetries, err = strconv.Atoi(v)
+		return
+	})
+	set("backoff", func(v string) (err error) {
+		policy.Backoff, err = time.ParseDuration(v)
+		return
+	})
+	set("maxbackoff", func(v string) (err error) {
+		policy.MaxBackoff, err = time.ParseDuration(v)
+		return
+	})
+	set("maxdelay", func(v string) (err error) {
+		policy.MaxDelay, err = time.ParseDuration(v)
+		return
+	})
+	set("jitter", func(v string) (err error) {
+		if policy.Jitter, err = strconv.ParseFloat(v, 64); err == nil {
+			// 超过1时等待时间可能为负数
+			policy.Jitter = math.Max(0, math.Min(policy.Jitter, 1))
+		}
+		return
+	})
+	set("giveup", func(v string) (err error) {
+		policy.GiveUp, err = time.ParseDuration(v)
+		return
+	})
+	return
+}
+
+func (p *HLSPuller) retryPolicy() *RetryPolicy {
+	if p.Retry != nil {
+		return p.Retry
+	}
+	return &hlsConfig.Retry
+}
+
+func (policy *RetryPolicy) backoff() backoff.Policy {
+	return backoff.Policy{Backoff: policy.Backoff, MaxBackoff: policy.MaxBackoff, MaxDelay: policy.MaxDelay, Jitter: policy.Jitter}
+}
+
+// window 重试期间最长的等待时间，不限次数也不限时长时返回 false
+func (policy *RetryPolicy) window() (window time.Duration, ok bool) {
+	if policy.MaxRetries >= 0 {
+		window, ok = policy.backoff().Total(policy.MaxRetries), true
+	}
+	if policy.GiveUp > 0 {
+		// 超过 GiveUp 之前开始的最后一次等待
+		if giveUp := policy.GiveUp + policy.backoff().Delay(math.MaxInt32, 1); !ok || giveUp < window {
+			window, ok = giveUp, true
+		}
+	}
+	return
+}
+
+// retrier 连续失败的次数和开始时间
+type retrier struct {
+	policy   *RetryPolicy
+	attempts int
+	since    time.Time
+}
+
+// wait 等待后重试，超过次数或时长、或者拉流已经停止时返回 false
+func (r *retrier) wait(p *HLSPuller, reason error) bool {
+	if r.attempts == 0 {
+		r.since = time.Now()
+	}
+	r.attempts++
+	if r.policy.MaxRetries >= 0 && r.attempts > r.policy.MaxRetries || r.policy.GiveUp > 0 && time.Since(r.since) > r.policy.GiveUp {
+		return false
+	}
+	d := r.policy.backoff().Delay(r.attempts, rand.Float64())
+	HLSPlugin.Warn("retry", zap.String("streamPath", p.Stream.Path), zap.Int("attempt", r.attempts), zap.Duration("delay", d), zap.Error(reason))
+	select {
+	case <-p.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// reset 请求成功后恢复
+func (r *retrier) reset(p *HLSPuller) {
+	if r.attempts > 0 {
+		HLSPlugin.Info("recovered", zap.String("streamPath", p.Stream.Path), zap.Int("attempts", r.attempts))
+		r.attempts = 0
+	}
+}
@@ -0,0 +1,279 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+// SAMPLE-AES 加密的ts，参考 Apple 的 MPEG-2 Stream Encryption Format for HTTP Live Streaming
+const (
+	STREAM_TYPE_SAMPLE_AES_H264 = 0xdb
+	STREAM_TYPE_SAMPLE_AES_AAC  = 0xcf
+)
+
+var ErrInvalidTsPacket = errors.New("invalid ts packet")
+
+// memoryBody 读入内存处理后的切片，关闭时关闭原始的响应
+type memoryBody struct {
+	*bytes.Reader
+	io.Closer
+}
+
+// newSampleAESReader 读取整个切片，解密其中的 H.264 和 AAC 后重新打包成普通的ts
+func newSampleAESReader(body io.ReadCloser, key, iv []byte) (io.ReadCloser, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = decryptSampleAES(data, key, iv); err != nil {
+		return nil, err
+	}
+	return memoryBody{bytes.NewReader(data), body}, nil
+}
+
+// sampleAESPES 正在拼接的加密PES
+type sampleAESPES struct {
+	streamType byte
+	af         []byte // 第一个ts包的 adaptation_field，只保留标志和PCR
+	data       []byte
+	cc         byte // 最后输出的ts包的 continuity_counter
+}
+
+// decryptSampleAES 把PMT中加密的流类型改回普通类型，解密PES负载后重新打包，其他ts包原样输出
+func decryptSampleAES(data []byte, key, iv []byte) (out []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	pmtPID := -1
+	streams := make(map[uint16]*sampleAESPES)
+	var pids []uint16
+	out = make([]byte, 0, len(data))
+	for ; len(data) >= mpegts.TS_PACKET_SIZE; data = data[mpegts.TS_PACKET_SIZE:] {
+		packet := data[:mpegts.TS_PACKET_SIZE]
+		if packet[0] != 0x47 {
+			return nil, ErrInvalidTsPacket
+		}
+		pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+		pusi := packet[1]&0x40 != 0
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if int(payload[0]) >= len(payload) {
+				return nil, ErrInvalidTsPacket
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if packet[3]&0x10 == 0 {
+			payload = nil
+		}
+		switch pes := streams[pid]; {
+		case pid == 0 && pusi:
+			pmtPID = parsePAT(psiSection(payload))
+		case int(pid) == pmtPID && pusi:
+			var encrypted []pmtStream
+			packet, encrypted = rewritePMT(packet, psiSection(payload))
+			for _, s := range encrypted {
+				if streams[s.pid] == nil {
+					pids = append(pids, s.pid)
+					streams[s.pid] = &sampleAESPES{streamType: s.streamType, cc: 0xff}
+				}
+			}
+		case pes != nil:
+			if pusi {
+				out = pes.flush(out, pid, block, iv)
+				pes.af = keepAdaptationField(packet)
+			} else if pes.data == nil {
+				continue
+			}
+			pes.data = append(pes.data, payload...)
+			if pes.cc == 0xff {
+				pes.cc = (packet[3] - 1) & 0x0f
+			}
+			continue
+		}
+		out = append(out, packet...)
+	}
+	for _, pid := range pids {
+		out = streams[pid].flush(out, pid, block, iv)
+	}
+	return
+}
+
+// rewritePMT 把 SAMPLE-AES 的流类型改成 H.264 和 AAC 后重新生成PMT的ts包并返回被修改的流，没有加密的流时返回原来的包
+func rewritePMT(packet []byte, section []byte) ([]byte, []pmtStream) {
+	pmt, ok := parsePMT(section)
+	if !ok {
+		return packet, nil
+	}
+	var encrypted []pmtStream
+	for i := range pmt.streams {
+		s := &pmt.streams[i]
+		switch s.streamType {
+		case STREAM_TYPE_SAMPLE_AES_H264:
+			s.streamType = mpegts.STREAM_TYPE_H264
+		case STREAM_TYPE_SAMPLE_AES_AAC:
+			s.streamType = mpegts.STREAM_TYPE_AAC
+		default:
+			continue
+		}
+		encrypted = append(encrypted, *s)
+	}
+	if len(encrypted) == 0 {
+		return packet, nil
+	}
+	pid := uint16(packet[1]&0x1f)<<8 | uint16(packet[2])
+	rewritten := psiPacket(pid, pmt.section())
+	rewritten[3] |= packet[3] & 0x0f
+	return rewritten, encrypted
+}
+
+// keepAdaptationField 重新打包时保留第一个ts包的标志和PCR
+func keepAdaptationField(packet []byte) []byte {
+	if packet[3]&0x20 == 0 || packet[4] == 0 {
+		return nil
+	}
+	flags := packet[5]
+	af := []byte{flags & 0xf0}
+	if flags&0x10 != 0 && packet[4] >= 7 {
+		af = append(af, packet[6:12]...)
+	} else {
+		af[0] &^= 0x10
+	}
+	return af
+}
+
+// flush 解密已经拼接完整的PES并重新打包成ts包
+func (pes *sampleAESPES) flush(out []byte, pid uint16, block cipher.Block, iv []byte) []byte {
+	data := pes.data
+	pes.data = nil
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 || 9+int(data[8]) > len(data) {
+		return out
+	}
+	header := data[:9+int(data[8])]
+	es := data[len(header):]
+	switch pes.streamType {
+	case mpegts.STREAM_TYPE_H264:
+		es = decryptH264(block, iv, es)
+	case mpegts.STREAM_TYPE_AAC:
+		decryptADTS(block, iv, es)
+	}
+	if length := len(header) - 6 + len(es); length > 0xffff {
+		header[4], header[5] = 0, 0
+	} else if header[4] != 0 || header[5] != 0 {
+		header[4], header[5] = byte(length>>8), byte(length)
+	}
+	return packetizePES(out, pid, pes.af, append(header, es...), &pes.cc)
+}
+
+// packetizePES 把PES打包成ts包，最后一个包用 adaptation_field 填充
+func packetizePES(out []byte, pid uint16, af []byte, pes []byte, cc *byte) []byte {
+	pusi := byte(0x40)
+	for len(pes) > 0 {
+		field := af
+		af = nil
+		space := mpegts.TS_PACKET_SIZE - 4
+		if field != nil {
+			space -= 1 + len(field)
+		}
+		if len(pes) < space {
+			if field == nil {
+				field = make([]byte, 0, space-len(pes))
+				if space--; space > len(pes) {
+					field = append(field, 0)
+					space--
+				}
+			}
+			for ; space > len(pes); space-- {
+				field = append(field, 0xff)
+			}
+		}
+		*cc = (*cc + 1) & 0x0f
+		ctrl := byte(0x10)
+		if field != nil {
+			ctrl |= 0x20
+		}
+		out = append(out, 0x47, pusi|byte(pid>>8)&0x1f, byte(pid), ctrl|*cc)
+		if field != nil {
+			out = append(out, byte(len(field)))
+			out = append(out, field...)
+		}
+		out = append(out, pes[:space]...)
+		pes = pes[space:]
+		pusi = 0
+	}
+	return out
+}
+
+// decryptH264 解密 Annex B 格式中加密的 NALU，长度会因去掉防竞争字节而变化
+func decryptH264(block cipher.Block, iv []byte, es []byte) []byte {
+	result := make([]byte, 0, len(es))
+	start, prev := -1, 0
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			for end > start && es[end-1] == 0 {
+				end--
+			}
+			result = append(result, es[prev:start]...)
+			result = append(result, decryptNALU(block, iv, es[start:end])...)
+			prev = end
+		}
+		i += 2
+		start = i + 1
+	}
+	if start < 0 {
+		return es
+	}
+	result = append(result, es[prev:start]...)
+	return append(result, decryptNALU(block, iv, es[start:])...)
+}
+
+// decryptNALU 类型为1和5且长度大于48的 NALU 被加密：前32字节不加密，之后每160字节加密开头的16字节。
+// 加密的是去掉防竞争字节后的数据，解密后重新插入防竞争字节，避免出现伪起始码
+func decryptNALU(block cipher.Block, iv []byte, nalu []byte) []byte {
+	if len(nalu) <= 48 {
+		return nalu
+	}
+	if t := nalu[0] & 0x1f; t != 1 && t != 5 {
+		return nalu
+	}
+	nalu = unescapeRBSP(nalu)
+	mode := cipher.NewCBCDecrypter(block, iv)
+	for data := nalu[32:]; len(data) > aes.BlockSize; {
+		mode.CryptBlocks(data[:aes.BlockSize], data[:aes.BlockSize])
+		if data = data[aes.BlockSize:]; len(data) > 144 {
+			data = data[144:]
+		} else {
+			break
+		}
+	}
+	return escapeRBSP(nalu)
+}
+
+// decryptADTS 每个ADTS帧头之后的16字节不加密，其余完整的分组加密
+func decryptADTS(block cipher.Block, iv []byte, es []byte) {
+	for len(es) >= 7 && es[0] == 0xff && es[1]&0xf0 == 0xf0 {
+		frameLen := int(es[3]&0x03)<<11 | int(es[4])<<3 | int(es[5]>>5)
+		header := 7
+		if es[1]&0x01 == 0 {
+			header = 9
+		}
+		if frameLen < header || frameLen > len(es) {
+			return
+		}
+		if frame := es[header:frameLen]; len(frame) > 16 {
+			encrypted := frame[16:]
+			encrypted = encrypted[:len(encrypted)/aes.BlockSize*aes.BlockSize]
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(encrypted, encrypted)
+		}
+		es = es[frameLen:]
+	}
+}
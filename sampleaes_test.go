@@ -0,0 +1,168 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+
+	"m7s.live/engine/v4/codec/mpegts"
+)
+
+var (
+	sampleAESKey = unhex("000102030405060708090a0b0c0d0e0f")
+	sampleAESIV  = unhex("101112131415161718191a1b1c1d1e1f")
+	// 明文 00000100000002000000030000000400 用上面的 key 和 iv 做 AES-128-CBC 加密的结果
+	sampleAESZeros = unhex("1ccc2e5eff6295c1f0e166bafb6d964c")
+	// 明文 0123456789abcdeffedcba9876543210 的加密结果
+	sampleAESPlain  = unhex("0123456789abcdeffedcba9876543210")
+	sampleAESCipher = unhex("3c743424b4885192076a977019b1c99f")
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func repeat(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func concat(parts ...[]byte) (b []byte) {
+	for _, part := range parts {
+		b = append(b, part...)
+	}
+	return
+}
+
+func TestDecryptNALU(t *testing.T) {
+	block, err := aes.NewCipher(sampleAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 前32字节不加密，之后16字节加密，剩余不足16字节的部分不加密
+	leader := concat([]byte{0x65}, repeat(0x88, 31))
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{
+			"short",
+			concat([]byte{0x65}, repeat(0x88, 47)),
+			concat([]byte{0x65}, repeat(0x88, 47)),
+		},
+		{
+			"not a slice",
+			concat([]byte{0x06}, repeat(0x88, 31), sampleAESCipher, repeat(0x22, 8)),
+			concat([]byte{0x06}, repeat(0x88, 31), sampleAESCipher, repeat(0x22, 8)),
+		},
+		{
+			"slice",
+			concat(leader, sampleAESCipher, repeat(0x22, 8)),
+			concat(leader, sampleAESPlain, repeat(0x22, 8)),
+		},
+		{
+			"start codes in decrypted data",
+			concat(leader, sampleAESZeros, repeat(0x22, 8)),
+			concat(leader, unhex("0000030100000300020000030003000003000400"), repeat(0x22, 8)),
+		},
+		{
+			// 去掉防竞争字节后才数前32字节
+			"emulation prevention in clear data",
+			concat([]byte{0x41}, repeat(0x88, 27), unhex("0000030122"), sampleAESCipher, repeat(0x22, 8)),
+			concat([]byte{0x41}, repeat(0x88, 27), unhex("0000030122"), sampleAESPlain, repeat(0x22, 8)),
+		},
+	}
+	for _, tt := range tests {
+		if got := decryptNALU(block, sampleAESIV, append([]byte(nil), tt.in...)); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// adtsFrame 生成 payload 前加上ADTS头的AAC帧
+func adtsFrame(payload ...[]byte) []byte {
+	data := concat(payload...)
+	return concat(adtsHeader(2, 4, 2, len(data)), data)
+}
+
+func TestDecryptADTS(t *testing.T) {
+	block, err := aes.NewCipher(sampleAESKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{
+			"clear frame",
+			adtsFrame(repeat(0x33, 16), repeat(0x44, 15)),
+			adtsFrame(repeat(0x33, 16), repeat(0x44, 15)),
+		},
+		{
+			"encrypted frame",
+			adtsFrame(repeat(0x33, 16), sampleAESCipher, repeat(0x44, 5)),
+			adtsFrame(repeat(0x33, 16), sampleAESPlain, repeat(0x44, 5)),
+		},
+		{
+			"two frames",
+			concat(adtsFrame(repeat(0x33, 16), sampleAESCipher), adtsFrame(repeat(0x33, 16), sampleAESCipher, repeat(0x44, 1))),
+			concat(adtsFrame(repeat(0x33, 16), sampleAESPlain), adtsFrame(repeat(0x33, 16), sampleAESPlain, repeat(0x44, 1))),
+		},
+	}
+	for _, tt := range tests {
+		got := append([]byte(nil), tt.in...)
+		if decryptADTS(block, sampleAESIV, got); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDecryptSampleAES(t *testing.T) {
+	const pid = 0x100
+	pat := psiPacket(0, []byte{0x00, 0, 0, 0x00, 0x01, 0xc1, 0, 0, 0x00, 0x01, 0xf0, 0x00})
+	pmt := psiPacket(0x1000, []byte{0x02, 0, 0, 0x00, 0x01, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00, STREAM_TYPE_SAMPLE_AES_H264, 0xe1, 0x00, 0xf0, 0x00})
+	header := appendPESTimestamp([]byte{0, 0, 1, STREAM_ID_VIDEO, 0, 0, 0x80, 0x80, 5}, 0x20, 90000)
+	aud := unhex("0000000109f0")
+	slice := concat([]byte{0x65}, repeat(0x88, 31), sampleAESZeros, repeat(0x22, 100))
+	cc := byte(0x0f)
+	in := concat(pat, pmt)
+	in = packetizePES(in, pid, nil, concat(header, aud, unhex("00000001"), slice), &cc)
+
+	out, err := decryptSampleAES(in, sampleAESKey, sampleAESIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out[:188], pat) {
+		t.Errorf("PAT changed: %x", out[:188])
+	}
+	section := out[188+5 : 188+5+21]
+	if section[12] != mpegts.STREAM_TYPE_H264 {
+		t.Errorf("stream type %#x, want %#x", section[12], mpegts.STREAM_TYPE_H264)
+	}
+	if crc := crc32MPEG2(section); crc != 0 {
+		t.Errorf("PMT CRC mismatch: %#x", crc)
+	}
+	var pes []byte
+	for packets := out[376:]; len(packets) >= 188; packets = packets[188:] {
+		packet := packets[:188]
+		if p := uint16(packet[1]&0x1f)<<8 | uint16(packet[2]); p != pid {
+			t.Fatalf("unexpected pid %#x", p)
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			payload = payload[1+int(payload[0]):]
+		}
+		pes = append(pes, payload...)
+	}
+	want := concat(header, aud, unhex("00000001"), slice[:32], unhex("0000030100000300020000030003000003000400"), repeat(0x22, 100))
+	if !bytes.Equal(pes, want) {
+		t.Errorf("got PES %x\nwant %x", pes, want)
+	}
+}
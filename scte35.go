@@ -0,0 +1,177 @@
+package hls
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// AdBreak 广告插播，在对应的切片上输出 #EXT-X-DATERANGE（带 SCTE35-OUT/IN），并在开始和结束处强制切片
+type AdBreak struct {
+	ID        string
+	StartDate time.Time
+	Duration  time.Duration
+	Cue       bool // 同时输出 #EXT-X-CUE-OUT/#EXT-X-CUE-IN
+	EventID   uint32
+}
+
+var adBreakEventID uint32
+
+// trackCue 插播点在某个轨道上的时间戳和输出状态
+type trackCue struct {
+	*AdBreak
+	start, end time.Duration
+	pts        uint64 // 插播开始的PTS，写入 splice_time
+	outTs      time.Duration
+	out, in    bool
+}
+
+// ScheduleAdBreak 为正在写入的HLS流安排一次广告插播，供其他插件调用
+func ScheduleAdBreak(streamPath string, b *AdBreak) error {
+	if hls, ok := memoryTs.Get(streamPath).(*HLSWriter); ok {
+		hls.ScheduleAdBreak(b)
+		return nil
+	}
+	return ErrNoHLSWriter
+}
+
+func (hls *HLSWriter) ScheduleAdBreak(b *AdBreak) {
+	if b.EventID == 0 {
+		b.EventID = atomic.AddUint32(&adBreakEventID, 1)
+	}
+	if b.ID == "" {
+		b.ID = "ad-" + strconv.FormatUint(uint64(b.EventID), 10)
+	}
+	now := time.Now()
+	if b.StartDate.IsZero() || b.StartDate.Before(now) {
+		b.StartDate = now
+	}
+	offset := b.StartDate.Sub(now)
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	add := func(t *TrackReader) {
+		t.cues = append(t.cues, &trackCue{
+			AdBreak: b,
+			start:   t.timestamp + offset,
+			end:     t.timestamp + offset + b.Duration,
+			pts:     uint64(t.pts) + uint64(offset.Milliseconds()*90),
+		})
+	}
+	for _, t := range hls.video_tracks {
+		add(&t.TrackReader)
+	}
+	for _, t := range hls.audio_tracks {
+		add(&t.TrackReader)
+	}
+}
+
+// cueDue 是否有插播的开始或结束落在 ts 之前，需要强制切片
+func (t *TrackReader) cueDue(ts time.Duration) bool {
+	for _, c := range t.cues {
+		if !c.out && ts >= c.start || c.out && !c.in && ts >= c.end {
+			return true
+		}
+	}
+	return false
+}
+
+// cueTags 返回从 ts 开始的切片之前需要输出的插播标签
+func (t *TrackReader) cueTags(ts time.Duration) (dateRanges []*m3u8.DateRange, tags []string) {
+	cues := t.cues[:0]
+	for _, c := range t.cues {
+		if !c.out && ts >= c.start {
+			c.out = true
+			c.outTs = ts
+			dateRanges = append(dateRanges, &m3u8.DateRange{
+				ID:              c.ID,
+				StartDate:       c.StartDate,
+				PlannedDuration: c.Duration.Seconds(),
+				SCTE35Out:       spliceInsert(c.EventID, true, c.pts, c.Duration),
+			})
+			if c.Cue {
+				tags = append(tags, fmt.Sprintf("#EXT-X-CUE-OUT:DURATION=%.3f", c.Duration.Seconds()))
+			}
+		}
+		if c.out && !c.in && ts >= c.end {
+			c.in = true
+			dateRanges = append(dateRanges, &m3u8.DateRange{
+				ID:        c.ID,
+				StartDate: c.StartDate,
+				Duration:  (ts - c.outTs).Seconds(),
+				SCTE35In:  spliceInsert(c.EventID, false, c.pts+uint64((ts-c.outTs).Milliseconds()*90), 0),
+			})
+			if c.Cue {
+				tags = append(tags, "#EXT-X-CUE-IN")
+			}
+		}
+		if !c.in {
+			cues = append(cues, c)
+		}
+	}
+	t.cues = cues
+	return
+}
+
+// spliceInsert 生成 SCTE-35 splice_info_section，命令为 splice_insert
+func spliceInsert(eventID uint32, out bool, pts uint64, duration time.Duration) []byte {
+	cmd := []byte{byte(eventID >> 24), byte(eventID >> 16), byte(eventID >> 8), byte(eventID), 0x7f}
+	flags := byte(0x4f) // program_splice_flag
+	if out {
+		flags |= 0x80 // out_of_network_indicator
+		if duration > 0 {
+			flags |= 0x20 // duration_flag
+		}
+	}
+	cmd = append(cmd, flags)
+	pts &= 0x1ffffffff
+	cmd = append(cmd, 0xfe|byte(pts>>32), byte(pts>>24), byte(pts>>16), byte(pts>>8), byte(pts))
+	if flags&0x20 != 0 {
+		d := uint64(duration.Milliseconds()*90) & 0x1ffffffff
+		cmd = append(cmd, 0xfe|byte(d>>32), byte(d>>24), byte(d>>16), byte(d>>8), byte(d)) // auto_return
+	}
+	cmd = append(cmd, 0, 0, 0, 0) // unique_program_id, avail_num, avails_expected
+	section := []byte{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xf0 | byte(len(cmd)>>8), byte(len(cmd)), 0x05}
+	section = append(section, cmd...)
+	section = append(section, 0, 0) // descriptor_loop_length
+	sectionLength := len(section) - 3 + 4
+	section[1] = 0x30 | byte(sectionLength>>8)&0x0f
+	section[2] = byte(sectionLength)
+	crc := crc32MPEG2(section)
+	return append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+}
+
+// API_AdBreak 安排广告插播，start 为 RFC3339 格式的开始时间（默认立即开始），duration 为插播时长，cue=1 时同时输出 CUE-OUT/CUE-IN
+func (config *HLSConfig) API_AdBreak(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	duration, err := time.ParseDuration(query.Get("duration"))
+	if err != nil || duration <= 0 {
+		util.ReturnError(util.APIErrorQueryParse, "invalid duration", w, r)
+		return
+	}
+	b := &AdBreak{
+		ID:       query.Get("id"),
+		Duration: duration,
+		Cue:      query.Get("cue") != "",
+	}
+	if start := query.Get("start"); start != "" {
+		if b.StartDate, err = time.Parse(time.RFC3339, start); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+	}
+	if strings.ContainsAny(b.ID, "\"\r\n") {
+		util.ReturnError(util.APIErrorQueryParse, "invalid id", w, r)
+		return
+	}
+	if err = ScheduleAdBreak(query.Get("streamPath"), b); err != nil {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
@@ -0,0 +1,217 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// Slate 无流时播放的默认切片
+type Slate struct {
+	Filter   *regexp.Regexp // 匹配播放列表名（流路径或流路径/轨道名），为空表示内置或 defaultts
+	Name     string         // 文件名，在播放列表中位于 slateDir 下
+	Data     StaticTs
+	Duration time.Duration
+}
+
+// slateDir 默认切片在播放列表中的保留目录，避免与流的切片重名
+const slateDir = "_slate"
+
+var defaultSlate = &Slate{Name: "default.ts"}
+var slates []*Slate
+
+// 每个默认切片条目之前都有 #EXT-X-DISCONTINUITY，所以序号每增加一，不连续序号也增加一
+const slateWindow = 1
+
+// slateTimeline 记录播放列表在切换到默认切片时的序号，使直播和默认切片之间来回切换时序号保持连续
+type slateTimeline struct {
+	used          int64     // 最后一次输出默认切片的时间（UnixNano），空闲超过 slateIdle 后删除
+	since         time.Time // 开始播放默认切片的时间
+	sequence      int       // since 时刻的媒体序号
+	discontinuity int       // since 时刻的不连续序号
+}
+
+var timelines sync.Map // 播放列表名 -> *slateTimeline
+var lastSweep int64    // 上次清理 timelines 的时间（UnixNano）
+
+const slateIdle = 5 * time.Minute
+
+// loadSlates 按正则表达式的字典序加载配置的默认切片，保证匹配顺序固定
+func (c *HLSConfig) loadSlates() (err error) {
+	patterns := make([]string, 0, len(c.Slates))
+	for pattern := range c.Slates {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for i, pattern := range patterns {
+		slate := &Slate{Name: "slate" + strconv.Itoa(i) + ".ts"}
+		if slate.Filter, err = regexp.Compile(pattern); err != nil {
+			return
+		}
+		if slate.Data, err = os.ReadFile(c.Slates[pattern]); err != nil {
+			return
+		}
+		if slate.Duration = tsDuration(slate.Data); slate.Duration == 0 {
+			return fmt.Errorf("can not get duration of %s", c.Slates[pattern])
+		}
+		slates = append(slates, slate)
+	}
+	return
+}
+
+// slateFor 返回播放列表名对应的默认切片
+func slateFor(name string) *Slate {
+	for _, slate := range slates {
+		if slate.Filter.MatchString(name) {
+			return slate
+		}
+	}
+	return defaultSlate
+}
+
+// getSlate 根据请求的路径查找默认切片，只接受 writeSlatePlaylist 输出的 slateDir 下的文件
+func getSlate(filePath string) *Slate {
+	if path.Base(path.Dir(filePath)) != slateDir {
+		return nil
+	}
+	fileName := path.Base(filePath)
+	if fileName == defaultSlate.Name {
+		return defaultSlate
+	}
+	if !strings.HasPrefix(fileName, "slate") {
+		return nil
+	}
+	if i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(fileName, "slate"), ".ts")); err == nil && i >= 0 && i < len(slates) {
+		return slates[i]
+	}
+	return nil
+}
+
+// current 返回 now 时刻默认切片播放列表的媒体序号和不连续序号
+func (tl *slateTimeline) current(slate *Slate, now time.Time) (sequence, discontinuity int) {
+	n := int(now.Sub(tl.since) / slate.Duration)
+	return tl.sequence + n, tl.discontinuity + n
+}
+
+// writeSlatePlaylist 输出播放列表名为 name 的默认切片播放列表，只为正在发布或之前直播过的流记录序号
+func writeSlatePlaylist(w io.Writer, name string) {
+	slate := slateFor(name)
+	now := time.Now()
+	sweepTimelines(now)
+	tl := &slateTimeline{since: now}
+	if v, ok := timelines.Load(name); ok {
+		tl = v.(*slateTimeline)
+	} else if Streams.Get(name) != nil || Streams.Get(path.Dir(name)) != nil {
+		v, _ := timelines.LoadOrStore(name, tl)
+		tl = v.(*slateTimeline)
+	}
+	atomic.StoreInt64(&tl.used, now.UnixNano())
+	sequence, discontinuity := tl.current(slate, now)
+	playlist := m3u8.MediaPlaylist{
+		Version:               3,
+		TargetDuration:        int(math.Ceil(slate.Duration.Seconds())),
+		MediaSequence:         sequence,
+		DiscontinuitySequence: discontinuity,
+	}
+	for i := 0; i < slateWindow; i++ {
+		playlist.Segments = append(playlist.Segments, &m3u8.Segment{
+			URI:           slateDir + "/" + slate.Name,
+			Duration:      slate.Duration.Seconds(),
+			Discontinuity: true,
+		})
+	}
+	playlist.Encode(w)
+}
+
+// sweepTimelines 每分钟最多清理一次空闲超过 slateIdle 的序号记录
+func sweepTimelines(now time.Time) {
+	last := atomic.LoadInt64(&lastSweep)
+	if now.UnixNano()-last < int64(time.Minute) || !atomic.CompareAndSwapInt64(&lastSweep, last, now.UnixNano()) {
+		return
+	}
+	timelines.Range(func(name, v any) bool {
+		if now.UnixNano()-atomic.LoadInt64(&v.(*slateTimeline).used) > int64(slateIdle) {
+			timelines.Delete(name)
+		}
+		return true
+	})
+}
+
+// resumeTimeline 该播放列表之前输出过默认切片时，直播从默认切片之后的序号开始，并在第一个切片前加上 #EXT-X-DISCONTINUITY，直播恢复后删除记录
+func (t *TrackReader) resumeTimeline() {
+	if v, ok := timelines.LoadAndDelete(t.m3u8Name); ok {
+		sequence, discontinuity := v.(*slateTimeline).current(slateFor(t.m3u8Name), time.Now())
+		t.playlist.Sequence = sequence + slateWindow
+		t.playlist.Discontinuity = discontinuity + slateWindow
+		t.resumeLive = true
+	}
+}
+
+// endTimeline 直播结束，之后的默认切片从直播最后一个切片之后的序号开始
+func (t *TrackReader) endTimeline() {
+	if t.M3u8.Len() == 0 {
+		return
+	}
+	sequence, discontinuity := t.playlist.Next()
+	now := time.Now()
+	timelines.Store(t.m3u8Name, &slateTimeline{
+		used:          now.UnixNano(),
+		since:         now,
+		sequence:      sequence,
+		discontinuity: discontinuity,
+	})
+}
+
+// tsDuration 根据第一个带PTS的PID估算ts的时长，加上平均帧间隔作为最后一帧的时长
+func tsDuration(data []byte) time.Duration {
+	pid := -1
+	var minPTS, maxPTS uint64
+	frames := 0
+	for ; len(data) >= mpegts.TS_PACKET_SIZE; data = data[mpegts.TS_PACKET_SIZE:] {
+		packet := data[:mpegts.TS_PACKET_SIZE]
+		if packet[0] != 0x47 || packet[1]&0x40 == 0 || packet[3]&0x10 == 0 {
+			continue
+		}
+		payload := packet[4:]
+		if packet[3]&0x20 != 0 {
+			if int(payload[0])+1 >= len(payload) {
+				continue
+			}
+			payload = payload[1+int(payload[0]):]
+		}
+		if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+			continue
+		}
+		if p := int(packet[1]&0x1f)<<8 | int(packet[2]); pid == -1 {
+			pid = p
+		} else if p != pid {
+			continue
+		}
+		pts := uint64(payload[9]>>1&0x07)<<30 | uint64(payload[10])<<22 | uint64(payload[11]>>1)<<15 | uint64(payload[12])<<7 | uint64(payload[13]>>1)
+		if frames == 0 || pts < minPTS {
+			minPTS = pts
+		}
+		if frames == 0 || pts > maxPTS {
+			maxPTS = pts
+		}
+		frames++
+	}
+	if frames < 2 {
+		return 0
+	}
+	span := maxPTS - minPTS
+	return time.Duration(span+span/uint64(frames-1)) * time.Millisecond / 90
+}
@@ -0,0 +1,294 @@
+package hls
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// StaticTs 预先封装好的ts文件，直接从内存中返回，用于服务端插播
+type StaticTs util.Buffer
+
+func (StaticTs) Recycle() {}
+
+// StitchBreak 服务端插播，插播期间媒体播放列表中的直播切片被素材目录中的切片替换，前后用 #EXT-X-DISCONTINUITY 分隔
+type StitchBreak struct {
+	ID        string
+	StartDate time.Time
+	Dir       string // 相对于 StitchPath 的素材目录，其中包含一个m3u8
+	seq       uint32 // 每次插播唯一，重复的 ID 也不会使切片重名
+	assets    []stitchAsset
+	duration  time.Duration
+}
+
+// stitchAsset 视频和音频分别在各自的播放列表中输出，素材按流类型拆开
+type stitchAsset struct {
+	duration float64
+	video    StaticTs
+	audio    StaticTs
+}
+
+var stitchID uint32
+
+var ErrInvalidStitchID = errors.New("stitch id may only contain letters, digits, _ and -")
+
+// trackStitch 服务端插播在某个轨道上的进度
+type trackStitch struct {
+	*StitchBreak
+	start  time.Duration
+	begun  bool          // 已在插播开始处切片
+	next   int           // 下一个要输出的素材
+	offset time.Duration // 下一个素材相对插播开始的时间
+}
+
+// load 读取素材目录中的m3u8，按顺序加载其中的ts
+func (b *StitchBreak) load() (err error) {
+	dir := filepath.Join(hlsConfig.StitchPath, filepath.FromSlash(path.Clean("/"+b.Dir)))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var playlist m3u8.Playlist
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".m3u8") {
+			if playlist, err = m3u8.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+				return
+			}
+			break
+		}
+	}
+	media, ok := playlist.(*m3u8.MediaPlaylist)
+	if !ok {
+		return errors.New("no media m3u8 in " + b.Dir)
+	}
+	for _, v := range media.Segments {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+v.URI))))
+		if err != nil {
+			return err
+		}
+		b.assets = append(b.assets, stitchAsset{
+			duration: v.Duration,
+			video:    filterTs(data, true),
+			audio:    filterTs(data, false),
+		})
+		b.duration += time.Duration(v.Duration * float64(time.Second))
+	}
+	if len(b.assets) == 0 {
+		return errors.New("no segment in " + b.Dir)
+	}
+	return
+}
+
+// ScheduleStitch 为正在写入的HLS流安排一次服务端插播，供其他插件调用
+func ScheduleStitch(streamPath string, b *StitchBreak) (err error) {
+	hls, ok := memoryTs.Get(streamPath).(*HLSWriter)
+	if !ok {
+		return ErrNoHLSWriter
+	}
+	if !validStitchID(b.ID) {
+		return ErrInvalidStitchID
+	}
+	if err = b.load(); err != nil {
+		return
+	}
+	hls.ScheduleStitch(b)
+	return
+}
+
+// validStitchID ID 会写入切片名和 DATERANGE 属性，只允许字母、数字、_ 和 -
+func validStitchID(id string) bool {
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (hls *HLSWriter) ScheduleStitch(b *StitchBreak) {
+	b.seq = atomic.AddUint32(&stitchID, 1)
+	if b.ID == "" {
+		b.ID = fmt.Sprintf("%d", b.seq)
+	}
+	now := time.Now()
+	var offset time.Duration
+	if b.StartDate.After(now) {
+		offset = b.StartDate.Sub(now)
+	}
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	for _, t := range hls.video_tracks {
+		t.addStitch(b, offset)
+	}
+	for _, t := range hls.audio_tracks {
+		t.addStitch(b, offset)
+	}
+}
+
+// addStitch 同一轨道上的插播不能重叠，重叠时顺延到上一次插播结束
+func (t *TrackReader) addStitch(b *StitchBreak, offset time.Duration) {
+	start := t.timestamp + offset
+	if l := len(t.stitches); l > 0 {
+		if end := t.stitches[l-1].start + t.stitches[l-1].duration; start < end {
+			start = end
+		}
+	}
+	t.stitches = append(t.stitches, &trackStitch{StitchBreak: b, start: start})
+	for _, asset := range b.assets {
+		if d := int(asset.duration + 0.999); d > t.playlist.Targetduration {
+			t.playlist.Targetduration = d
+		}
+	}
+}
+
+// stitchDue 插播的开始或结束落在 ts 之前，需要强制切片
+func (t *TrackReader) stitchDue(ts time.Duration) bool {
+	if len(t.stitches) == 0 {
+		return false
+	}
+	s := t.stitches[0]
+	if !s.begun {
+		return ts >= s.start
+	}
+	return ts >= s.start+s.duration
+}
+
+// stitch 用插播素材替换 [segStart, segEnd) 的直播切片，调用者需持有 muxLock
+func (t *TrackReader) stitch(hls *HLSWriter, inf *PlaylistInf, segStart, segEnd time.Duration) {
+	if len(t.stitches) > 0 {
+		s := t.stitches[0]
+		if segEnd >= s.start {
+			s.begun = true
+		}
+		if segStart >= s.start {
+			inf.Replaced = true
+			for ; s.next < len(s.assets) && s.start+s.offset < segEnd; s.next++ {
+				asset := s.assets[s.next]
+				// 每个轨道的窗口各自滑动并删除切片，素材按轨道分开存放
+				name := fmt.Sprintf("%s_stitch%s_%d_%d.ts", t.Track.Name, s.ID, s.seq, s.next)
+				data := asset.video
+				if t.pes.Pid == mpegts.PID_AUDIO {
+					data = asset.audio
+				}
+				sub := PlaylistInf{
+					Duration:      asset.duration,
+					Title:         name,
+					FilePath:      hls.Stream.Path + "/" + name,
+					Discontinuity: s.next == 0,
+				}
+				hls.memoryTs.Store(sub.FilePath, data)
+				inf.Substitute = append(inf.Substitute, sub)
+				s.offset += time.Duration(asset.duration * float64(time.Second))
+			}
+			if s.next == len(s.assets) && segEnd >= s.start+s.offset {
+				t.stitches = t.stitches[1:]
+				t.resumeLive = true
+			}
+			return
+		}
+	}
+	if t.resumeLive {
+		inf.Discontinuity = true
+		t.resumeLive = false
+	}
+}
+
+// filterTs 只保留素材中的视频流或者非视频流，重新生成PMT，PCR不在保留的流上时改用第一个保留的PID
+func filterTs(data []byte, video bool) StaticTs {
+	pmtPID := -1
+	keep := map[int]bool{0: true}
+	out := make([]byte, 0, len(data))
+	for ; len(data) >= mpegts.TS_PACKET_SIZE; data = data[mpegts.TS_PACKET_SIZE:] {
+		packet := data[:mpegts.TS_PACKET_SIZE]
+		if packet[0] != 0x47 {
+			continue
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		if packet[1]&0x40 != 0 && (pid == 0 && pmtPID == -1 || pid == pmtPID) {
+			var section []byte
+			if payload := packet[4:]; packet[3]&0x20 == 0 {
+				section = psiSection(payload)
+			} else if int(payload[0])+1 < len(payload) {
+				section = psiSection(payload[1+int(payload[0]):])
+			}
+			if pid == 0 {
+				// 使用第一个节目
+				if pmtPID = parsePAT(section); pmtPID != -1 {
+					keep[pmtPID] = true
+				}
+			} else if rewritten := filterPMT(section, video, keep); rewritten != nil {
+				packet = psiPacket(uint16(pid), rewritten)
+				packet[3] |= data[3] & 0x0f
+			}
+		}
+		if keep[pid] {
+			out = append(out, packet...)
+		}
+	}
+	return out
+}
+
+// filterPMT 生成只包含保留的流的PMT section，不含CRC，保留的PID记录在 keep 中
+func filterPMT(section []byte, video bool, keep map[int]bool) []byte {
+	pmt, ok := parsePMT(section)
+	if !ok {
+		return nil
+	}
+	streams := pmt.streams[:0]
+	for _, s := range pmt.streams {
+		switch s.streamType {
+		case 0x01, 0x02, 0x10, mpegts.STREAM_TYPE_H264, mpegts.STREAM_TYPE_H265:
+			if !video {
+				continue
+			}
+		default:
+			if video {
+				continue
+			}
+		}
+		keep[int(s.pid)] = true
+		streams = append(streams, s)
+	}
+	pmt.streams = streams
+	if !keep[int(pmt.pcrPID)] && len(streams) > 0 {
+		pmt.pcrPID = streams[0].pid
+	}
+	return pmt.section()
+}
+
+// API_Stitch 安排服务端插播，dir 为相对于 stitchpath 的素材目录，可选 start（RFC3339）、id
+func (config *HLSConfig) API_Stitch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	b := &StitchBreak{
+		ID:  query.Get("id"),
+		Dir: query.Get("dir"),
+	}
+	if config.StitchPath == "" || b.Dir == "" {
+		util.ReturnError(util.APIErrorQueryParse, "stitchpath and dir required", w, r)
+		return
+	}
+	if start := query.Get("start"); start != "" {
+		var err error
+		if b.StartDate, err = time.Parse(time.RFC3339, start); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+	}
+	if err := ScheduleStitch(query.Get("streamPath"), b); err == ErrNoHLSWriter {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
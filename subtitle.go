@@ -0,0 +1,215 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// SubtitleCue 一条字幕，Start 为零时表示立即开始
+type SubtitleCue struct {
+	Start time.Time
+	End   time.Time
+	Text  string
+}
+
+// subtitleCue 换算成参考视频轨道时间戳的字幕
+type subtitleCue struct {
+	start, end time.Duration
+	text       string
+}
+
+const maxSubtitleCues = 256 // 尚未输出的字幕数上限
+
+// SubtitleReader WebVTT 字幕的媒体播放列表，切片与默认视频轨道的切片对齐
+type SubtitleReader struct {
+	sync.RWMutex
+	M3u8     util.Buffer
+	playlist Playlist
+	m3u8Name string
+	source   *TrackReader  // 参考的视频轨道
+	cues     []subtitleCue // 尚未完全输出的字幕
+	segments []PlaylistInf // 播放列表中的切片
+	sequence int           // 第一个切片的媒体序号
+	count    uint32
+}
+
+func (s *SubtitleReader) init(hls *HLSWriter, source *TrackReader) {
+	s.source = source
+	s.m3u8Name = hls.Stream.Path + "/subtitle"
+	s.playlist = Playlist{
+		Writer:         &s.M3u8,
+		Version:        3,
+		Targetduration: int(hlsConfig.Fragment / time.Millisecond / 666),
+	}
+}
+
+// PushSubtitle 向正在写入的HLS流推送一条字幕，供其他插件调用
+func PushSubtitle(streamPath string, cue SubtitleCue) error {
+	if hls, ok := memoryTs.Get(streamPath).(*HLSWriter); ok {
+		return hls.PushSubtitle(cue)
+	}
+	return ErrNoHLSWriter
+}
+
+// PushSubtitle 没有字幕播放列表（未配置 subtitle 或没有视频轨道）时返回 ErrNoHLSWriter
+func (hls *HLSWriter) PushSubtitle(cue SubtitleCue) error {
+	now := time.Now()
+	if cue.Start.IsZero() {
+		cue.Start = now
+	}
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	s := hls.subtitle
+	if s == nil {
+		return ErrNoHLSWriter
+	}
+	s.add(subtitleCue{
+		start: s.source.timestamp + cue.Start.Sub(now),
+		end:   s.source.timestamp + cue.End.Sub(now),
+		text:  cue.Text,
+	})
+	return nil
+}
+
+// pushSubtitlePTS 推送拉流导入的字幕，按参考轨道最后一帧的PTS换算成时间戳，没有字幕播放列表时返回 false
+func (hls *HLSWriter) pushSubtitlePTS(cue vttCue) bool {
+	hls.muxLock.Lock()
+	defer hls.muxLock.Unlock()
+	s := hls.subtitle
+	if s == nil {
+		return false
+	}
+	offset := func(pts uint64) time.Duration {
+		return s.source.timestamp + time.Duration(int32(uint32(pts)-s.source.pts))*time.Second/90000
+	}
+	s.add(subtitleCue{
+		start: offset(cue.start),
+		end:   offset(cue.end),
+		text:  cue.text,
+	})
+	return true
+}
+
+// add 加入一条字幕，丢弃在正在写入的切片之前已经结束的字幕，超过上限时丢弃最早的，调用者需持有 muxLock
+func (s *SubtitleReader) add(cue subtitleCue) {
+	if cue.end <= s.source.write_time {
+		return
+	}
+	if len(s.cues) >= maxSubtitleCues {
+		s.cues = append(s.cues[:0], s.cues[1:]...)
+	}
+	s.cues = append(s.cues, cue)
+}
+
+// frag 参考轨道完成了 [start, end) 的切片，输出同一时间段的 WebVTT，调用者需持有 muxLock
+func (s *SubtitleReader) frag(hls *HLSWriter, start, end time.Duration) {
+	var vtt util.Buffer
+	// LOCAL 为0时对应的PTS，字幕的时间直接使用轨道时间戳
+	base := (int64(s.source.pts) - s.source.timestamp.Milliseconds()*90) & 0x1ffffffff
+	fmt.Fprintf(&vtt, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", base)
+	cues := s.cues[:0]
+	for _, c := range s.cues {
+		if c.start < end && c.end > start {
+			fmt.Fprintf(&vtt, "\n%s --> %s\n%s\n", vttTime(c.start), vttTime(c.end), vttText(c.text))
+		}
+		if c.end > end {
+			cues = append(cues, c)
+		}
+	}
+	s.cues = cues
+	name := "subtitle" + strconv.FormatInt(time.Now().Unix(), 10) + "_" + strconv.FormatUint(uint64(s.count), 10) + ".vtt"
+	s.count++
+	inf := PlaylistInf{
+		Duration: (end - start).Seconds(),
+		Title:    name,
+		FilePath: hls.Stream.Path + "/" + name,
+	}
+	HLSPlugin.Debug("write vtt", zap.String("vttFilePath", inf.FilePath))
+	hls.memoryTs.Store(inf.FilePath, StaticTs(vtt))
+	s.Lock()
+	defer s.Unlock()
+	if d := int(math.Ceil(inf.Duration)); d > s.playlist.Targetduration {
+		s.playlist.Targetduration = d
+	}
+	s.segments = append(s.segments, inf)
+	if len(s.segments) > hlsConfig.Window {
+		hls.memoryTs.Delete(s.segments[0].FilePath)
+		s.segments = s.segments[1:]
+		s.sequence++
+	}
+	s.M3u8.Reset()
+	s.playlist.Sequence = s.sequence
+	s.playlist.Init()
+	for _, inf := range s.segments {
+		s.playlist.WriteInf(inf)
+	}
+	if _, loaded := memoryM3u8.LoadOrStore(s.m3u8Name, s); !loaded {
+		hlsNotifier.Notify(s.m3u8Name)
+	}
+}
+
+// vttTime 把时间戳格式化为 WebVTT 的 hh:mm:ss.ttt
+func vttTime(t time.Duration) string {
+	if t < 0 {
+		t = 0
+	}
+	ms := t.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// vttText 转义字幕文本，去掉会结束当前字幕的空行
+func vttText(text string) string {
+	text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	result := lines[:0]
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+// API_Subtitle 推送一条字幕，请求体为字幕文本，start、end 为 RFC3339 格式的时间，也可以用 duration 代替 end，start 省略时立即开始
+func (config *HLSConfig) API_Subtitle(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	body, err := io.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		util.ReturnError(util.APIErrorQueryParse, "subtitle body required", w, r)
+		return
+	}
+	cue := SubtitleCue{Text: string(body)}
+	if start := query.Get("start"); start != "" {
+		if cue.Start, err = time.Parse(time.RFC3339, start); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+	} else {
+		cue.Start = time.Now()
+	}
+	if end := query.Get("end"); end != "" {
+		cue.End, err = time.Parse(time.RFC3339, end)
+	} else {
+		var duration time.Duration
+		duration, err = time.ParseDuration(query.Get("duration"))
+		cue.End = cue.Start.Add(duration)
+	}
+	if err != nil || !cue.End.After(cue.Start) {
+		util.ReturnError(util.APIErrorQueryParse, "invalid end or duration", w, r)
+		return
+	}
+	if err = PushSubtitle(query.Get("streamPath"), cue); err != nil {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
@@ -0,0 +1,118 @@
+package hls
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+// 拉取主播放列表时选择变体的策略
+const (
+	VARIANT_HIGHEST    = "highest"    // 分辨率最高，相同时码率最高
+	VARIANT_LOWEST     = "lowest"     // 分辨率最低，相同时码率最低
+	VARIANT_BANDWIDTH  = "bandwidth"  // bandwidth:3000000 不超过该码率的最高码率，都超过时选码率最低的
+	VARIANT_RESOLUTION = "resolution" // resolution:1280x720 或 resolution:720 最接近该分辨率
+	VARIANT_NAME       = "name"       // name:720p 匹配 NAME 属性
+	VARIANT_CODEC      = "codec"      // codec:avc1 匹配 CODECS 属性中的编码，多个时选分辨率最高的
+	VARIANT_URI        = "uri"        // uri:地址 匹配变体的 URI
+	VARIANT_ALL        = "all"        // 每个变体拉成单独的流，只能拉一路时同 highest
+)
+
+var ErrNoVariant = errors.New("no variant in master playlist")
+
+// higher 比较两个变体的分辨率，相同时比较码率
+func higher(a, b *m3u8.Variant) bool {
+	if a.Width*a.Height != b.Width*b.Height {
+		return a.Width*a.Height > b.Width*b.Height
+	}
+	return a.Bandwidth > b.Bandwidth
+}
+
+// selectVariant 按策略从主播放列表中选择一个变体，忽略I帧变体
+func selectVariant(variants []*m3u8.Variant, policy string) (selected *m3u8.Variant, err error) {
+	kind, value, _ := strings.Cut(policy, ":")
+	var better func(v, selected *m3u8.Variant) bool
+	match := func(*m3u8.Variant) bool { return true }
+	switch kind {
+	case "", VARIANT_HIGHEST, VARIANT_ALL:
+		better = higher
+	case VARIANT_LOWEST:
+		better = func(v, selected *m3u8.Variant) bool { return higher(selected, v) }
+	case VARIANT_BANDWIDTH:
+		max, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+		better = func(v, selected *m3u8.Variant) bool {
+			if (v.Bandwidth <= max) != (selected.Bandwidth <= max) {
+				return v.Bandwidth <= max
+			}
+			if v.Bandwidth <= max {
+				return v.Bandwidth > selected.Bandwidth
+			}
+			return v.Bandwidth < selected.Bandwidth
+		}
+	case VARIANT_RESOLUTION:
+		width, height := 0, 0
+		if w, h, ok := strings.Cut(value, "x"); ok {
+			width, err = strconv.Atoi(w)
+			if err == nil {
+				height, err = strconv.Atoi(h)
+			}
+		} else {
+			height, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		distance := func(v *m3u8.Variant) int {
+			d := abs(v.Height - height)
+			if width > 0 {
+				d += abs(v.Width - width)
+			}
+			return d
+		}
+		better = func(v, selected *m3u8.Variant) bool {
+			if distance(v) != distance(selected) {
+				return distance(v) < distance(selected)
+			}
+			return v.Bandwidth > selected.Bandwidth
+		}
+	case VARIANT_NAME:
+		better = higher
+		match = func(v *m3u8.Variant) bool { return strings.EqualFold(v.Name, value) }
+	case VARIANT_CODEC:
+		better = higher
+		match = func(v *m3u8.Variant) bool {
+			for _, codec := range strings.Split(v.Codecs, ",") {
+				if strings.HasPrefix(strings.TrimSpace(codec), value) {
+					return true
+				}
+			}
+			return false
+		}
+	case VARIANT_URI:
+		better = higher
+		match = func(v *m3u8.Variant) bool { return v.URI == value }
+	default:
+		return nil, errors.New("unknown variant policy " + policy)
+	}
+	for _, v := range variants {
+		if !v.IFrame && match(v) && (selected == nil || better(v, selected)) {
+			selected = v
+		}
+	}
+	if selected == nil {
+		err = ErrNoVariant
+	}
+	return
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
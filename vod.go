@@ -0,0 +1,188 @@
+package hls
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/plugin/hls/v4/m3u8"
+)
+
+const (
+	maxTimestamp = 1<<33 - 1
+	vodGap       = 90000 / 25 // 不连续时新时间戳与上一个时间戳之间的间隔
+	vodMaxJump   = 10 * 90000 // 时间戳跳变超过10秒时视为不连续
+	vodBatch     = 3          // 每次同时下载的切片数量
+)
+
+// vodPlayer 拉取点播m3u8（#EXT-X-ENDLIST）时按顺序下载全部切片，并按时间戳实时发布
+type vodPlayer struct {
+	media    *m3u8.MediaPlaylist // 只请求一次的播放列表
+	next     int                 // 下一个要下载的切片
+	loops    int                 // 已经循环的次数
+	relayed  int                 // 已经转发的切片数量
+	timeline vodTimeline
+}
+
+// items 返回接下来要下载的切片，播放完且不循环时返回空
+func (vod *vodPlayer) items(client *http.Client, media *m3u8.MediaPlaylist, loop bool) (items []*TSDownloader) {
+	vod.media = media
+	if vod.next >= len(media.Segments) {
+		if !loop || len(media.Segments) == 0 {
+			return nil
+		}
+		vod.next = 0
+		vod.loops++
+	}
+	// 切片的密钥和初始化片段从之前的切片继承
+	var key *m3u8.Key
+	var initMap *m3u8.Map
+	for i, v := range media.Segments {
+		if v.Key != nil {
+			key = v.Key
+		}
+		if v.Map != nil {
+			initMap = v.Map
+		}
+		if i < vod.next || v.Gap {
+			continue
+		}
+		if len(items) == vodBatch {
+			break
+		}
+		items = append(items, &TSDownloader{
+			client:        client,
+			uri:           v.URI,
+			byteRange:     v.ByteRange,
+			dur:           v.Duration,
+			key:           key,
+			sequence:      media.MediaSequence + i,
+			initMap:       initMap,
+			buffered:      true,
+			discontinuity: v.Discontinuity || i == 0 && vod.loops > 0,
+		})
+		vod.next = i + 1
+	}
+	if len(items) == 0 {
+		vod.next = len(media.Segments)
+	}
+	return
+}
+
+// vodTimeline 改写点播切片的时间戳，使不连续处和循环之后的时间戳保持递增，并根据时间戳控制发布速度
+type vodTimeline struct {
+	start   time.Time     // 发布第一个时间戳的时间
+	offset  uint64        // 加到时间戳上的偏移
+	last    uint64        // 输出的最大时间戳
+	elapsed time.Duration // 从第一个时间戳到 last 的时长
+	started bool
+	rebase  bool // 下一个时间戳需要重新计算偏移
+}
+
+func (tl *vodTimeline) rewrite(ts uint64) uint64 {
+	if !tl.started {
+		tl.started, tl.start, tl.last = true, time.Now(), ts
+		return ts
+	}
+	out := (ts + tl.offset) & maxTimestamp
+	if d := (out - tl.last) & maxTimestamp; tl.rebase || d > vodMaxJump && d < maxTimestamp-vodMaxJump {
+		tl.offset = (tl.last + vodGap - ts) & maxTimestamp
+		tl.rebase = false
+		out = (ts + tl.offset) & maxTimestamp
+	}
+	if d := (out - tl.last) & maxTimestamp; d <= vodMaxJump {
+		tl.elapsed += time.Duration(d) * time.Second / 90000
+		tl.last = out
+	}
+	return out
+}
+
+// wait 等待到时间戳对应的发布时间
+func (tl *vodTimeline) wait(ctx context.Context) {
+	if d := time.Until(tl.start.Add(tl.elapsed)); d > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+	}
+}
+
+// vodPacer 逐个读取ts包，改写其中的PTS、DTS和PCR，遇到时间戳时等待到对应的发布时间
+type vodPacer struct {
+	io.ReadCloser
+	ctx      context.Context
+	timeline *vodTimeline
+	packet   [mpegts.TS_PACKET_SIZE]byte
+	pending  []byte
+}
+
+func (vod *vodPlayer) pace(ctx context.Context, body io.ReadCloser, discontinuity bool) io.ReadCloser {
+	if discontinuity {
+		vod.timeline.rebase = true
+	}
+	return &vodPacer{ReadCloser: body, ctx: ctx, timeline: &vod.timeline}
+}
+
+func (r *vodPacer) Read(b []byte) (n int, err error) {
+	if len(r.pending) == 0 {
+		if _, err = io.ReadFull(r.ReadCloser, r.packet[:]); err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			return
+		}
+		if r.rewrite(r.packet[:]) {
+			r.timeline.wait(r.ctx)
+		}
+		r.pending = r.packet[:]
+	}
+	n = copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return
+}
+
+// rewrite 改写ts包中的时间戳，返回是否包含PES的时间戳
+func (r *vodPacer) rewrite(packet []byte) (hasTimestamp bool) {
+	if packet[0] != 0x47 {
+		return
+	}
+	payload := packet[4:]
+	if packet[3]&0x20 != 0 {
+		if int(payload[0]) >= len(payload) {
+			return
+		}
+		payload = payload[1+int(payload[0]):]
+	}
+	if packet[1]&0x40 != 0 && packet[3]&0x10 != 0 && len(payload) >= 19 && payload[0] == 0 && payload[1] == 0 && payload[2] == 1 {
+		switch flags := payload[7] >> 6; flags {
+		case 2, 3:
+			hasTimestamp = true
+			putTimestamp(payload[9:], r.timeline.rewrite(getTimestamp(payload[9:])))
+			if flags == 3 {
+				putTimestamp(payload[14:], (getTimestamp(payload[14:])+r.timeline.offset)&maxTimestamp)
+			}
+		}
+	}
+	// PCR
+	if packet[3]&0x20 != 0 && packet[4] >= 7 && packet[5]&0x10 != 0 {
+		pcr := (uint64(packet[6])<<25 | uint64(packet[7])<<17 | uint64(packet[8])<<9 | uint64(packet[9])<<1 | uint64(packet[10])>>7) + r.timeline.offset
+		packet[6], packet[7], packet[8], packet[9] = byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1)
+		packet[10] = byte(pcr<<7) | packet[10]&0x7f
+	}
+	return
+}
+
+func getTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 | uint64(b[1])<<22 | uint64(b[2]>>1)<<15 | uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// putTimestamp 保留前缀的4位和标记位
+func putTimestamp(b []byte, ts uint64) {
+	b[0] = b[0]&0xf1 | byte(ts>>29)&0x0e
+	b[1] = byte(ts >> 22)
+	b[2] = byte(ts>>14)&0xfe | b[2]&0x01
+	b[3] = byte(ts >> 7)
+	b[4] = byte(ts<<1)&0xfe | b[4]&0x01
+}
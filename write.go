@@ -4,6 +4,7 @@ import (
 	"container/ring"
 	"fmt"
 	"math"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +16,7 @@ import (
 	"m7s.live/engine/v4/codec/mpegts"
 	"m7s.live/engine/v4/track"
 	"m7s.live/engine/v4/util"
+	"m7s.live/plugin/hls/v4/m3u8"
 )
 
 var memoryTs util.Map[string, interface {
@@ -22,6 +24,52 @@ var memoryTs util.Map[string, interface {
 }]
 var memoryM3u8 sync.Map
 var pools sync.Pool
+var hlsNotifier = streamNotifier{chans: make(map[string]*notifyChan)}
+
+// streamNotifier 用于唤醒等待 m3u8/ts 的 http 请求，每次 Notify 都会关闭旧的通道
+type streamNotifier struct {
+	sync.Mutex
+	chans map[string]*notifyChan
+}
+
+// notifyChan 等待同一个 key 的请求共用的通道，没有请求等待时删除
+type notifyChan struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// Wait 返回一个在 key 下次被通知时关闭的通道，需在检查条目之前调用以免错过通知，不再等待时需调用返回的 cancel
+func (n *streamNotifier) Wait(key string) (<-chan struct{}, func()) {
+	n.Lock()
+	defer n.Unlock()
+	c, ok := n.chans[key]
+	if !ok {
+		c = &notifyChan{ch: make(chan struct{})}
+		n.chans[key] = c
+	}
+	c.waiters++
+	var once sync.Once
+	return c.ch, func() {
+		once.Do(func() {
+			n.Lock()
+			defer n.Unlock()
+			if c.waiters--; c.waiters == 0 && n.chans[key] == c {
+				delete(n.chans, key)
+			}
+		})
+	}
+}
+
+func (n *streamNotifier) Notify(keys ...string) {
+	n.Lock()
+	defer n.Unlock()
+	for _, key := range keys {
+		if c, ok := n.chans[key]; ok {
+			close(c.ch)
+			delete(n.chans, key)
+		}
+	}
+}
 
 func init() {
 	pools.New = func() any {
@@ -33,20 +81,40 @@ type TrackReader struct {
 	sync.RWMutex
 	M3u8 util.Buffer
 	pes  *mpegts.MpegtsPESFrame
-	ts   *MemoryTs
+	ts   *MemorySegment
 	*track.AVRingReader
 	write_time         time.Duration
 	m3u8Name           string
+	prefetch           string // 正在写入的切片名，开启 progressive 时用 #EXT-X-PREFETCH 追加到 m3u8 末尾
 	hls_segment_count  uint32 // hls segment count
 	playlist           Playlist
 	infoRing           *ring.Ring
 	hls_playlist_count uint32
 	hls_segment_window uint32
+	IFrameM3u8         util.Buffer      // I帧播放列表，仅视频轨道
+	iframeSegments     []*MemorySegment // I帧播放列表包含的切片
+	iframeSequence     int
+	pts                uint32               // 最后写入的帧的PTS，用于插入ID3
+	timestamp          time.Duration        // 最后写入的帧的时间戳
+	cues               []*trackCue          // 尚未结束的广告插播
+	interstitials      []*trackInterstitial // 尚未输出的插播内容
+	stitches           []*trackStitch       // 尚未结束的服务端插播
+	resumeLive         bool                 // 服务端插播结束，下一个直播切片前需要 #EXT-X-DISCONTINUITY
+	id3                bool                 // PMT中已声明ID3元数据流
+	id3cc              byte
+}
+
+// IFramePlaylist 用于在 memoryM3u8 中区分I帧播放列表
+type IFramePlaylist struct {
+	*TrackReader
 }
 
 func (tr *TrackReader) init(hls *HLSWriter, media *track.Media, pid uint16) {
-	tr.ts = &MemoryTs{
-		BytesPool: hls.pool,
+	tr.ts = &MemorySegment{
+		MemoryTs: &MemoryTs{
+			BytesPool: hls.pool,
+		},
+		lock: &hls.muxLock,
 	}
 	tr.pes = &mpegts.MpegtsPESFrame{
 		Pid: pid,
@@ -63,6 +131,106 @@ func (tr *TrackReader) init(hls *HLSWriter, media *track.Media, pid uint16) {
 	}
 }
 
+// MemorySegment 写入者产生的ts切片，正在写入时也可以被读取，数据以 chunked 方式边写边发
+type MemorySegment struct {
+	*MemoryTs
+	Title    string
+	lock     *sync.Mutex // 即 HLSWriter.muxLock，保护切片的写入和读取
+	changed  chan struct{}
+	complete bool
+	iframes  []IFrameInf
+}
+
+// IFrameInf 关键帧在ts切片中的位置，用于生成I帧播放列表
+type IFrameInf struct {
+	Timestamp time.Duration
+	Offset    int
+	Length    int
+}
+
+// Size 返回切片当前的字节数（包含PAT和PMT各一个ts包），BLL 写入时已累计 ByteLength，无需遍历，调用者需持有 lock
+func (s *MemorySegment) Size() int {
+	return mpegts.TS_PACKET_SIZE + len(s.PMT) + s.ByteLength
+}
+
+// addIFrame 记录刚写入的关键帧，offset 为写入前的 Size，调用者需持有 lock
+func (s *MemorySegment) addIFrame(ts time.Duration, offset int) {
+	s.iframes = append(s.iframes, IFrameInf{
+		Timestamp: ts,
+		Offset:    offset,
+		Length:    s.Size() - offset,
+	})
+}
+
+// written 每写入一帧后调用，唤醒正在读取该切片的请求，调用者需持有 lock
+func (s *MemorySegment) written() {
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// finish 切片写入结束，调用者需持有 lock
+func (s *MemorySegment) finish() {
+	s.complete = true
+	s.written()
+}
+
+// appendFrom 把 BLL 中 offset 之后新写入的数据追加到 buf，已发送的部分只跳过不复制，调用者需持有 lock
+func (s *MemorySegment) appendFrom(buf []byte, offset int) []byte {
+	pos := 0
+	s.BLL.Range(func(b util.Buffer) bool {
+		if end := pos + len(b); end > offset {
+			if offset > pos {
+				b = b[offset-pos:]
+			}
+			buf = append(buf, b...)
+		}
+		pos += len(b)
+		return true
+	})
+	return buf
+}
+
+func (s *MemorySegment) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, _ := w.(http.Flusher)
+	sent, head := 0, 0 // 已发送的字节数，PAT和PMT的长度
+	var buf util.Buffer
+	for {
+		buf.Reset()
+		s.lock.Lock()
+		if sent == 0 {
+			s.MemoryTs.WriteTo(&buf)
+			head = buf.Len() - s.ByteLength
+		} else {
+			buf = s.appendFrom(buf, sent-head)
+		}
+		complete := s.complete
+		if !complete && s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.lock.Unlock()
+		if buf.Len() > 0 {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+			sent += buf.Len()
+			if flusher != nil && !complete {
+				flusher.Flush()
+			}
+		}
+		if complete {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
 type AudioTrackReader struct {
 	TrackReader
 	*track.Audio
@@ -71,6 +239,7 @@ type AudioTrackReader struct {
 type VideoTrackReader struct {
 	TrackReader
 	*track.Video
+	captions []string // 在SEI中检测到的 CEA-608 通道，例如 CC1
 }
 
 type HLSWriter struct {
@@ -80,6 +249,8 @@ type HLSWriter struct {
 	Subscriber
 	memoryTs     util.Map[string, util.Recyclable]
 	lastReadTime time.Time
+	muxLock      sync.Mutex // 多个轨道共用 pool，写入时需要互斥
+	subtitle     *SubtitleReader
 }
 
 func (hls *HLSWriter) GetTs(key string) util.Recyclable {
@@ -91,28 +262,93 @@ func (hls *HLSWriter) Start(streamPath string) {
 	hls.pool = pools.Get().(util.BytesPool)
 	if err := HLSPlugin.Subscribe(streamPath, hls); err != nil {
 		HLSPlugin.Error("HLS Subscribe", zap.Error(err))
+		pools.Put(hls.pool)
+		streamPath = strings.Split(streamPath, "?")[0]
+		if !hlsConfig.Preload {
+			writingMap.Delete(streamPath)
+		}
+		hlsNotifier.Notify(streamPath)
 		return
 	}
 	streamPath = strings.Split(streamPath, "?")[0]
 	memoryTs.Add(streamPath, hls)
 	hls.ReadTrack()
 	memoryTs.Delete(streamPath)
+	hls.muxLock.Lock()
+	for _, t := range hls.video_tracks {
+		t.ts.finish()
+	}
+	for _, t := range hls.audio_tracks {
+		t.ts.finish()
+	}
 	hls.memoryTs.Range(func(k string, v util.Recyclable) {
 		v.Recycle()
 	})
+	hls.muxLock.Unlock()
 	pools.Put(hls.pool)
 	memoryM3u8.Delete(streamPath)
 	for _, t := range hls.video_tracks {
+		t.endTimeline()
 		memoryM3u8.Delete(t.m3u8Name)
+		memoryM3u8.Delete(t.m3u8Name + "_iframes")
 	}
 	for _, t := range hls.audio_tracks {
+		t.endTimeline()
 		memoryM3u8.Delete(t.m3u8Name)
 	}
+	if hls.subtitle != nil {
+		memoryM3u8.Delete(hls.subtitle.m3u8Name)
+	}
 	if !hlsConfig.Preload {
 		writingMap.Delete(streamPath)
 	}
+	// 唤醒仍在等待的请求，让它们得知写入已经结束
+	hlsNotifier.Notify(streamPath)
+	for _, t := range hls.video_tracks {
+		hlsNotifier.Notify(t.m3u8Name)
+	}
+	for _, t := range hls.audio_tracks {
+		hlsNotifier.Notify(t.m3u8Name)
+	}
+	if hls.subtitle != nil {
+		hlsNotifier.Notify(hls.subtitle.m3u8Name)
+	}
 }
 func (hls *HLSWriter) ReadTrack() {
+	var subtitle *SubtitleReader
+	if len(hls.video_tracks) > 0 && hlsConfig.Subtitle != "" {
+		subtitle = new(SubtitleReader)
+		subtitle.init(hls, &hls.video_tracks[0].TrackReader)
+	}
+	// PushSubtitle 可能同时在其他协程中读取
+	hls.muxLock.Lock()
+	hls.subtitle = subtitle
+	hls.writeMaster()
+	hls.muxLock.Unlock()
+	if !hlsConfig.Preload {
+		go hls.checkIdle()
+	}
+	// 每个轨道一个协程阻塞读取，有新帧时立即写入，空闲的流不消耗CPU
+	var wg sync.WaitGroup
+	for _, t := range hls.video_tracks {
+		wg.Add(1)
+		go func(t *VideoTrackReader) {
+			defer wg.Done()
+			hls.readVideo(t)
+		}(t)
+	}
+	for _, t := range hls.audio_tracks {
+		wg.Add(1)
+		go func(t *AudioTrackReader) {
+			defer wg.Done()
+			hls.readAudio(t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// writeMaster 生成主播放列表，检测到隐藏字幕或生成I帧播放列表时会重新生成，调用者需持有 muxLock
+func (hls *HLSWriter) writeMaster() {
 	var defaultAudio *AudioTrackReader
 	var defaultVideo *VideoTrackReader
 	if len(hls.video_tracks) > 0 {
@@ -120,68 +356,138 @@ func (hls *HLSWriter) ReadTrack() {
 	}
 	if len(hls.audio_tracks) > 0 {
 		defaultAudio = hls.audio_tracks[0]
-		if defaultVideo != nil {
-			for defaultAudio.IDRing == nil && !hls.IsClosed() {
-				time.Sleep(time.Millisecond * 10)
-			}
-			defaultAudio.Ring = defaultAudio.IDRing
-		} else {
-			defaultAudio.Ring = defaultAudio.Track.Ring
-		}
 	}
-	var audioGroup string
-	m3u8 := `#EXTM3U
-#EXT-X-VERSION:3`
+	master := m3u8.MasterPlaylist{Version: 4}
 	if defaultAudio != nil {
-		audioGroup = `,AUDIO="audio"`
-		m3u8 += fmt.Sprintf(`
-#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="%s",DEFAULT=YES,AUTOSELECT=YES,URI="%s/%s.m3u8?sub=1"`, defaultAudio.Track.Name, hls.Stream.StreamName, defaultAudio.Track.Name)
+		master.Renditions = append(master.Renditions, &m3u8.Rendition{
+			Type:       m3u8.MEDIA_TYPE_AUDIO,
+			GroupID:    "audio",
+			Name:       defaultAudio.Track.Name,
+			Default:    true,
+			Autoselect: true,
+			URI:        fmt.Sprintf("%s/%s.m3u8?sub=1", hls.Stream.StreamName, defaultAudio.Track.Name),
+		})
+	}
+	if hls.subtitle != nil {
+		master.Renditions = append(master.Renditions, &m3u8.Rendition{
+			Type:       m3u8.MEDIA_TYPE_SUBTITLES,
+			GroupID:    "subs",
+			Name:       "subtitle",
+			Language:   hlsConfig.Subtitle,
+			Default:    true,
+			Autoselect: true,
+			URI:        hls.Stream.StreamName + "/subtitle.m3u8?sub=1",
+		})
 	}
 	if defaultVideo != nil {
-		m3u8 += fmt.Sprintf(`
-#EXT-X-STREAM-INF:BANDWIDTH=2962000,NAME="%s",RESOLUTION=%dx%d%s
-%s/%s.m3u8?sub=1`, defaultVideo.Track.Name, defaultVideo.Width, defaultVideo.Height, audioGroup, hls.Stream.StreamName, defaultVideo.Track.Name)
+		variant := &m3u8.Variant{
+			URI:       fmt.Sprintf("%s/%s.m3u8?sub=1", hls.Stream.StreamName, defaultVideo.Track.Name),
+			Bandwidth: 2962000,
+			Name:      defaultVideo.Track.Name,
+			Width:     int(defaultVideo.Width),
+			Height:    int(defaultVideo.Height),
+		}
+		if defaultAudio != nil {
+			variant.Audio = "audio"
+		}
+		if hls.subtitle != nil {
+			variant.Subtitles = "subs"
+		}
+		for i, id := range defaultVideo.captions {
+			master.Renditions = append(master.Renditions, &m3u8.Rendition{
+				Type:       m3u8.MEDIA_TYPE_CLOSED_CAPTIONS,
+				GroupID:    "cc",
+				Name:       id,
+				Default:    i == 0,
+				Autoselect: true,
+				InstreamID: id,
+			})
+			variant.ClosedCaptions = "cc"
+		}
+		master.Variants = append(master.Variants, variant)
+		// I帧播放列表在第一个切片写完后才生成，届时会重新生成主播放列表
+		if _, ok := memoryM3u8.Load(defaultVideo.m3u8Name + "_iframes"); ok {
+			master.Variants = append(master.Variants, &m3u8.Variant{
+				URI:       fmt.Sprintf("%s/%s_iframes.m3u8?sub=1", hls.Stream.StreamName, defaultVideo.Track.Name),
+				Bandwidth: 296200,
+				Width:     int(defaultVideo.Width),
+				Height:    int(defaultVideo.Height),
+				IFrame:    true,
+			})
+		}
 	}
 	// 存一个默认的m3u8
-	memoryM3u8.Store(hls.Stream.Path, m3u8)
+	memoryM3u8.Store(hls.Stream.Path, master.String())
+	hlsNotifier.Notify(hls.Stream.Path)
+	notifyLadder(hls.Stream.Path)
+}
+
+// 任意一个轨道读取出错都会停止整个订阅，从而让其他轨道的阻塞读取返回
+func (hls *HLSWriter) readVideo(t *VideoTrackReader) {
+	defer hls.Stop(zap.String("reason", "video track read end"))
 	for hls.IO.Err() == nil {
-		for _, t := range hls.video_tracks {
-			for {
-				frame, err := t.TryRead()
-				if err != nil {
-					return
-				}
-				if frame == nil {
-					break
-				}
-				if frame.IFrame {
-					t.TrackReader.frag(hls, frame.Timestamp)
-				}
-				t.pes.IsKeyFrame = frame.IFrame
-				if err = t.ts.WriteVideoFrame(VideoFrame{frame, t.Video, t.AbsTime, uint32(frame.PTS), uint32(frame.DTS)}, t.pes); err != nil {
-					return
-				}
-			}
+		if err := t.AVRingReader.ReadFrame(track.SUBMODE_REAL); err != nil {
+			return
 		}
-		for _, t := range hls.audio_tracks {
-			for {
-				frame, err := t.TryRead()
-				if err != nil {
-					return
-				}
-				if frame == nil {
-					break
-				}
-				t.TrackReader.frag(hls, frame.Timestamp)
-				t.pes.IsKeyFrame = false
-				if err = t.ts.WriteAudioFrame(AudioFrame{frame, t.Audio, t.AbsTime, uint32(frame.PTS), uint32(frame.DTS)}, t.pes); err != nil {
-					return
-				}
-			}
+		frame := t.AVRingReader.Value
+		hls.muxLock.Lock()
+		var offset int
+		if frame.IFrame {
+			t.TrackReader.frag(hls, frame.Timestamp)
+			offset = t.ts.Size()
+		}
+		t.pes.IsKeyFrame = frame.IFrame
+		t.pts = uint32(frame.PTS)
+		t.timestamp = frame.Timestamp
+		err := t.ts.WriteVideoFrame(VideoFrame{frame, t.Video, t.AbsTime, uint32(frame.PTS), uint32(frame.DTS)}, t.pes)
+		if err == nil && frame.IFrame {
+			t.ts.addIFrame(frame.Timestamp, offset)
+		}
+		t.ts.written()
+		if err == nil && t.detectCaptions(frame) && t == hls.video_tracks[0] {
+			hls.writeMaster()
+		}
+		hls.muxLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (hls *HLSWriter) readAudio(t *AudioTrackReader) {
+	defer hls.Stop(zap.String("reason", "audio track read end"))
+	for hls.IO.Err() == nil {
+		if err := t.AVRingReader.ReadFrame(track.SUBMODE_REAL); err != nil {
+			return
 		}
-		time.Sleep(time.Millisecond * 10)
-		if !hlsConfig.Preload && !hls.lastReadTime.IsZero() && time.Since(hls.lastReadTime) > time.Second*15 {
-			hls.Stop(zap.String("reason", "no reader after 15s"))
+		frame := t.AVRingReader.Value
+		hls.muxLock.Lock()
+		t.TrackReader.frag(hls, frame.Timestamp)
+		t.pes.IsKeyFrame = false
+		t.pts = uint32(frame.PTS)
+		t.timestamp = frame.Timestamp
+		err := t.ts.WriteAudioFrame(AudioFrame{frame, t.Audio, t.AbsTime, uint32(frame.PTS), uint32(frame.DTS)}, t.pes)
+		t.ts.written()
+		hls.muxLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// 非预加载模式下，超过15秒没有人读取ts则停止订阅
+func (hls *HLSWriter) checkIdle() {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hls.Done():
+			return
+		case <-ticker.C:
+			if !hls.lastReadTime.IsZero() && time.Since(hls.lastReadTime) > time.Second*15 {
+				hls.Stop(zap.String("reason", "no reader after 15s"))
+				return
+			}
 		}
 	}
 }
@@ -189,8 +495,7 @@ func (hls *HLSWriter) ReadTrack() {
 func (t *TrackReader) frag(hls *HLSWriter, ts time.Duration) (err error) {
 	streamPath := hls.Stream.Path
 	// 当前的时间戳减去上一个ts切片的时间戳
-	if dur := ts - t.write_time; dur >= hlsConfig.Fragment {
-		// fmt.Println("time :", video.Timestamp, tsSegmentTimestamp)
+	if dur := ts - t.write_time; dur >= hlsConfig.Fragment || t.cueDue(ts) || t.stitchDue(ts) {
 		if dur == ts && t.write_time == 0 { //时间戳不对的情况，首个默认为2s
 			dur = time.Duration(2) * time.Second
 		}
@@ -198,31 +503,65 @@ func (t *TrackReader) frag(hls *HLSWriter, ts time.Duration) (err error) {
 		tsFilename := t.Track.Name + strconv.FormatInt(time.Now().Unix(), 10) + "_" + strconv.FormatUint(uint64(num), 10) + ".ts"
 		tsFilePath := streamPath + "/" + tsFilename
 
-		// println(hls.currentTs.Length)
-		t.ts = &MemoryTs{
-			BytesPool: t.ts.BytesPool,
-			PMT:       t.ts.PMT,
+		last := t.ts
+		last.finish()
+		t.ts = &MemorySegment{
+			MemoryTs: &MemoryTs{
+				BytesPool: last.BytesPool,
+				PMT:       last.PMT,
+			},
+			Title: tsFilename,
+			lock:  last.lock,
 		}
 		HLSPlugin.Debug("write ts", zap.String("tsFilePath", tsFilePath))
 		hls.memoryTs.Store(tsFilePath, t.ts)
 		if t.playlist.Targetduration < int(dur.Seconds()) {
 			t.playlist.Targetduration = int(math.Ceil(dur.Seconds()))
 		}
-		if t.M3u8.Len() == 0 {
-			t.playlist.Init()
-		}
 		inf := PlaylistInf{
 			//浮点计算精度
 			Duration: dur.Seconds(),
 			Title:    tsFilename,
 			FilePath: tsFilePath,
 		}
+		now := time.Now()
+		inf.DateRanges, inf.Tags = t.cueTags(ts)
+		inf.DateRanges = append(inf.DateRanges, t.interstitialDateRanges(ts, now)...)
+		if len(inf.DateRanges) > 0 || len(inf.Tags) > 0 {
+			// 使用 DATERANGE 时必须有 PROGRAM-DATE-TIME
+			inf.ProgramDateTime = now
+		}
 		t.Lock()
 		defer t.Unlock()
 
+		if last.Title != "" && len(last.iframes) > 0 && t.writeIFramePlaylist(last, ts) {
+			hls.writeMaster()
+		}
+		if last.Title != "" && hls.subtitle != nil && hls.subtitle.source == t {
+			hls.subtitle.frag(hls, t.write_time, ts)
+		}
 		if t.hls_segment_count > 0 {
+			if t.M3u8.Len() == 0 {
+				// 播放列表第一次输出前才确定起始序号，与此前输出的默认切片衔接
+				t.resumeTimeline()
+				if err = t.playlist.Init(); err != nil {
+					return
+				}
+			}
+			if len(t.stitches) > 0 || t.resumeLive {
+				prev := t.infoRing.Prev()
+				prevInf := prev.Value.(PlaylistInf)
+				t.stitch(hls, &prevInf, t.write_time, ts)
+				prev.Value = prevInf
+			}
 			if t.hls_playlist_count >= uint32(hlsConfig.Window) {
 				t.M3u8.Reset()
+				// 移出播放列表的条目可能包含多个插播切片
+				if dropped, ok := t.infoRing.Value.(PlaylistInf); ok {
+					segments, discontinuities := dropped.Count()
+					t.playlist.Sequence += segments - 1
+					t.playlist.Discontinuity += discontinuities
+				}
 				if err = t.playlist.Init(); err != nil {
 					return
 				}
@@ -235,14 +574,20 @@ func (t *TrackReader) frag(hls *HLSWriter, ts time.Duration) (err error) {
 					return
 				}
 			}
-			memoryM3u8.LoadOrStore(t.m3u8Name, t)
+			if _, loaded := memoryM3u8.LoadOrStore(t.m3u8Name, t); !loaded {
+				hlsNotifier.Notify(t.m3u8Name)
+			}
 			t.hls_playlist_count++
 		}
 
 		if t.hls_segment_count >= t.hls_segment_window {
-			if mts, loaded := hls.memoryTs.Delete(t.infoRing.Value.(PlaylistInf).FilePath); loaded {
+			dropped := t.infoRing.Value.(PlaylistInf)
+			if mts, loaded := hls.memoryTs.Delete(dropped.FilePath); loaded {
 				mts.Recycle()
 			}
+			for _, sub := range dropped.Substitute {
+				hls.memoryTs.Delete(sub.FilePath)
+			}
 			t.infoRing.Value = inf
 			t.infoRing = t.infoRing.Next()
 		} else {
@@ -251,11 +596,72 @@ func (t *TrackReader) frag(hls *HLSWriter, ts time.Duration) (err error) {
 		}
 		t.hls_segment_count++
 		t.write_time = ts
+		if hlsConfig.Progressive {
+			t.prefetch = tsFilename
+		}
+		hlsNotifier.Notify(streamPath)
 
 	}
 	return
 }
 
+// writeIFramePlaylist 把刚写完的切片加入I帧播放列表，next 为下一个切片的起始时间戳，第一次生成时返回 true，调用者需持有写锁
+func (t *TrackReader) writeIFramePlaylist(last *MemorySegment, next time.Duration) bool {
+	t.iframeSegments = append(t.iframeSegments, last)
+	if len(t.iframeSegments) > hlsConfig.Window {
+		t.iframeSequence += len(t.iframeSegments[0].iframes)
+		t.iframeSegments = t.iframeSegments[1:]
+	}
+	type entry struct {
+		IFrameInf
+		title    string
+		duration time.Duration
+	}
+	var entries []entry
+	for _, seg := range t.iframeSegments {
+		for _, iframe := range seg.iframes {
+			if l := len(entries); l > 0 {
+				entries[l-1].duration = iframe.Timestamp - entries[l-1].Timestamp
+			}
+			entries = append(entries, entry{IFrameInf: iframe, title: seg.Title})
+		}
+	}
+	entries[len(entries)-1].duration = next - entries[len(entries)-1].Timestamp
+	target := 1
+	for _, e := range entries {
+		if d := int(math.Ceil(e.duration.Seconds())); d > target {
+			target = d
+		}
+	}
+	playlist := m3u8.MediaPlaylist{
+		Version:        5,
+		TargetDuration: target,
+		MediaSequence:  t.iframeSequence,
+		IFramesOnly:    true,
+	}
+	mapTitle := ""
+	for _, e := range entries {
+		segment := &m3u8.Segment{
+			URI:       e.title,
+			Duration:  e.duration.Seconds(),
+			ByteRange: &m3u8.ByteRange{Length: int64(e.Length), Offset: int64(e.Offset)},
+		}
+		// PAT和PMT位于每个切片的开头
+		if e.title != mapTitle {
+			mapTitle = e.title
+			segment.Map = &m3u8.Map{URI: e.title, ByteRange: &m3u8.ByteRange{Length: mpegts.TS_PACKET_SIZE * 2}}
+		}
+		playlist.Segments = append(playlist.Segments, segment)
+	}
+	t.IFrameM3u8.Reset()
+	playlist.Encode(&t.IFrameM3u8)
+	if _, loaded := memoryM3u8.LoadOrStore(t.m3u8Name+"_iframes", IFramePlaylist{t}); !loaded {
+		hlsNotifier.Notify(t.m3u8Name + "_iframes")
+		return true
+	}
+	return false
+}
+
 func (hls *HLSWriter) OnEvent(event any) {
 	switch v := event.(type) {
 	case *track.Video:
@@ -264,7 +670,6 @@ func (hls *HLSWriter) OnEvent(event any) {
 		}
 		track.init(hls, &v.Media, mpegts.PID_VIDEO)
 		track.ts.WritePMTPacket(0, v.CodecID)
-		track.Ring = track.IDRing
 		hls.video_tracks = append(hls.video_tracks, track)
 	case *track.Audio:
 		if v.CodecID != codec.CodecID_AAC {